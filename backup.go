@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// localOnlyEntries are paths inside the config folder that must never be committed
+var localOnlyEntries = []string{
+	".backups/",
+	".state/",
+	"local.json",
+}
+
+// ensureLocalIgnores makes sure the config folder's .gitignore lists every local-only entry
+func ensureLocalIgnores(folder ShorthandPath) error {
+	ignorePath := folder.Suffix(".gitignore").FullPath
+
+	existing, err := os.ReadFile(ignorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		lines[strings.TrimSpace(line)] = true
+	}
+
+	var missing []string
+	for _, entry := range localOnlyEntries {
+		if !lines[entry] {
+			missing = append(missing, entry)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	content := string(existing)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += strings.Join(missing, "\n") + "\n"
+
+	return os.WriteFile(ignorePath, []byte(content), 0644)
+}
+
+// BackupSession collects the files overwritten by a single restore run
+// Backups live in ~/.config-sync/.backups/<timestamp>/<md5>/<basename>
+type BackupSession struct {
+	folder  ShorthandPath
+	dir     string
+	saved   map[string]string // Tracked paths and their backups, for Rollback
+	created []string          // Tracked paths that didn't exist before the restore
+}
+
+// NewBackupSession creates a backup session in the given config folder
+// The backup directory is only created once something is actually backed up
+func NewBackupSession(folder ShorthandPath) *BackupSession {
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	return &BackupSession{
+		folder: folder,
+		dir:    folder.Suffix(filepath.Join(".backups", stamp)).FullPath,
+		saved:  make(map[string]string),
+	}
+}
+
+// Backup copies the current content of a tracked path before it gets overwritten
+// Does nothing if the path doesn't exist or already matches the incoming content
+func (b *BackupSession) Backup(ctx context.Context, tildePath string, incoming string) error {
+	current := ShorthandPath{}.New(tildePath)
+
+	currentInfo, err := os.Stat(current.FullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			b.created = append(b.created, tildePath)
+			return nil
+		}
+		return err
+	}
+
+	if same, err := sameContent(ctx, current.FullPath, incoming); err == nil && same {
+		return nil
+	}
+
+	if err := ensureLocalIgnores(b.folder); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+
+	destDir := filepath.Join(b.dir, md5Hash(tildePath))
+	if err := os.MkdirAll(destDir, 0700); err != nil {
+		return err
+	}
+	destPath := filepath.Join(destDir, filepath.Base(current.FullPath))
+
+	if currentInfo.IsDir() {
+		err = copyDir(ctx, current.FullPath, destPath)
+	} else {
+		err = copyFile(ctx, current.FullPath, destPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.saved[tildePath] = destPath
+	log.Printf("Backed up %s -> %s\n", tildePath, collapseToTilde(destPath))
+	return nil
+}
+
+// Rollback undoes a restore that stopped halfway
+// Backed up paths get their previous content back and paths the restore created are removed.
+// It deliberately ignores cancellation and the file_copy timeout, an interrupt or a slow copy is usually why it runs
+func (b *BackupSession) Rollback() error {
+	ctx := withoutCopyTimeout(context.Background())
+	var errs []error
+	for _, tildePath := range slices.Sorted(maps.Keys(b.saved)) {
+		current := ShorthandPath{}.New(tildePath).FullPath
+		backup := b.saved[tildePath]
+
+		info, err := os.Stat(backup)
+		if err == nil {
+			err = os.RemoveAll(current)
+		}
+		if err == nil && info.IsDir() {
+			err = copyDir(ctx, backup, current)
+		} else if err == nil {
+			err = copyFile(ctx, backup, current)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tildePath, err))
+			continue
+		}
+		log.Printf("Rolled back %s\n", tildePath)
+	}
+
+	for _, tildePath := range b.created {
+		if err := os.RemoveAll(ShorthandPath{}.New(tildePath).FullPath); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tildePath, err))
+			continue
+		}
+		log.Printf("Removed partially restored %s\n", tildePath)
+	}
+	return errors.Join(errs...)
+}
+
+// sameContent reports whether two files or directories have identical content
+func sameContent(ctx context.Context, a, b string) (bool, error) {
+	hashes, errs := hashPaths(ctx, []string{a, b}, fileHash)
+	if err := errors.Join(errs...); err != nil {
+		return false, err
+	}
+	return hashes[0] == hashes[1], nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// BootstrapOptions are the settings of a bootstrap run
+type BootstrapOptions struct {
+	URL     string
+	Profile string // Saved to local.json when set
+	Yes     bool   // Replace existing files that differ without asking
+	Force   bool   // Clone even if the repository appears to be public
+	Shell   string // Shell to install the prompt hook for, empty detects it from $SHELL, "none" skips it
+}
+
+// BootstrapSummary is what a bootstrap run did
+type BootstrapSummary struct {
+	Cloned    bool     `json:"cloned"` // False when the repository was already cloned and only pulled
+	Profile   string   `json:"profile,omitempty"`
+	Created   []string `json:"created"`   // Tracked paths that didn't exist on this machine
+	Replaced  []string `json:"replaced"`  // Existing paths that differed, their old content is in Backups
+	Unchanged []string `json:"unchanged"` // Existing paths that already matched
+	Missing   []string `json:"missing"`   // Tracked paths without a synced copy
+	Backups   string   `json:"backups,omitempty"`
+	ShellHook string   `json:"shell_hook"` // Where the prompt hook is loaded from, or why it isn't
+}
+
+// Bootstrap sets up this machine from a config-sync repository in one go:
+// clone (or pull when already cloned), save the profile, restore every tracked path and install the prompt hook
+// Existing files that differ are only replaced with options.Yes or when confirmReplace agrees, and are backed up first.
+// Running it again only pulls and restores what changed
+func Bootstrap(ctx context.Context, config *JsonConfig, options BootstrapOptions, confirmReplace func([]string) bool) (BootstrapSummary, error) {
+	var summary BootstrapSummary
+	folder := configFolder()
+
+	cloned, err := ensureClone(ctx, NewGitRunner(), config, folder, options)
+	if err != nil {
+		return summary, err
+	}
+	summary.Cloned = cloned
+
+	if err := loadOrCreateConfig(config, folder); err != nil {
+		return summary, err
+	}
+	if appTimeouts, err = ResolveTimeouts(config); err != nil {
+		return summary, err
+	}
+
+	lock, err := AcquireRepoLock(folder, true, appTimeouts.LockWait)
+	if err != nil {
+		return summary, err
+	}
+	defer lock.Release()
+
+	if options.Profile != "" {
+		settings, err := LoadLocalSettings(folder)
+		if err != nil {
+			return summary, err
+		}
+		settings.Profile = options.Profile
+		if err := settings.Save(folder); err != nil {
+			return summary, fmt.Errorf("saving the profile failed: %w", err)
+		}
+	}
+	summary.Profile = activeProfile()
+
+	if !cloned {
+		git, err := NewConfiguredGitRunner(config)
+		if err != nil {
+			return summary, fmt.Errorf("loading signing settings failed: %w", err)
+		}
+		if err := pullChanges(ctx, git, false); err != nil {
+			return summary, fmt.Errorf("pull failed: %w", err)
+		}
+		if err := config.Reload(); err != nil {
+			return summary, fmt.Errorf("reloading config failed: %w", err)
+		}
+	}
+
+	syncDir := folder.Suffix("synced-files").FullPath
+	if err := summary.classify(ctx, config, syncDir); err != nil {
+		return summary, err
+	}
+	if len(summary.Replaced) > 0 && !options.Yes && !confirmReplace(summary.Replaced) {
+		return summary, fmt.Errorf("%d existing %s left unchanged, rerun with --yes to back up and replace them",
+			len(summary.Replaced), plural(len(summary.Replaced), "file", "files"))
+	}
+
+	backups := NewBackupSession(folder)
+	restore := append(slices.Clone(summary.Created), summary.Replaced...)
+	if err := config.restoreFrom(ctx, syncDir, restore, backups, false); err != nil {
+		return summary, fmt.Errorf("restore failed: %w", err)
+	}
+	if len(backups.saved) > 0 {
+		summary.Backups = collapseToTilde(backups.dir)
+	}
+
+	summary.ShellHook = installBootstrapHook(options.Shell)
+	return summary, nil
+}
+
+// ensureClone clones url into the config folder, unless the folder already holds a clone of it
+// A setup without an origin is adopted like init-from does. Returns whether it cloned
+func ensureClone(ctx context.Context, git GitRunner, config *JsonConfig, folder ShorthandPath, options BootstrapOptions) (bool, error) {
+	if _, err := os.Stat(folder.Suffix(".git").FullPath); err == nil {
+		remotes, err := git.Remotes(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, remote := range remotes {
+			if remote.Name != primaryRemote {
+				continue
+			}
+			if sameRepoURL(remote.URL, options.URL) {
+				log.Printf("%s is already cloned from %s, pulling\n", folder.TildePath, options.URL)
+				return false, nil
+			}
+			return false, fmt.Errorf("%s is already set up with origin %s, not %s", folder.TildePath, remote.URL, options.URL)
+		}
+	}
+
+	if !options.Force {
+		if err := refusePublicRepo(options.URL); err != nil {
+			return false, err
+		}
+	}
+	if err := InitFrom(ctx, git, config, options.URL, false); err != nil {
+		return false, fmt.Errorf("clone failed: %w", err)
+	}
+	return true, nil
+}
+
+// sameRepoURL compares repository URLs, ignoring a trailing slash or .git
+func sameRepoURL(a, b string) bool {
+	normalize := func(url string) string {
+		return strings.TrimSuffix(strings.TrimRight(url, "/"), ".git")
+	}
+	return normalize(a) == normalize(b)
+}
+
+// classify sorts the tracked paths by what restoring them would do
+func (s *BootstrapSummary) classify(ctx context.Context, config *JsonConfig, syncDir string) error {
+	for _, tildePath := range config.trackedPaths() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		synced := filepath.Join(syncDir, md5Hash(tildePath), filepath.Base(tildePath))
+		if _, err := os.Lstat(synced); err != nil {
+			s.Missing = append(s.Missing, tildePath)
+			continue
+		}
+		current := ShorthandPath{}.New(tildePath).FullPath
+		if _, err := os.Lstat(current); errors.Is(err, os.ErrNotExist) {
+			s.Created = append(s.Created, tildePath)
+			continue
+		}
+		if same, err := sameContent(ctx, current, synced); err == nil && same {
+			s.Unchanged = append(s.Unchanged, tildePath)
+			continue
+		}
+		s.Replaced = append(s.Replaced, tildePath)
+	}
+	return nil
+}
+
+// installBootstrapHook installs the prompt hook for shell, or the shell from $SHELL when it's empty
+// Returns the line for the summary, a failure only ends up there since everything else is already set up
+func installBootstrapHook(shell string) string {
+	if shell == "none" {
+		return "skipped"
+	}
+	if shell == "" {
+		shell = filepath.Base(os.Getenv("SHELL"))
+		if !slices.Contains(promptShells, shell) {
+			return "skipped, no supported shell in $SHELL (use --shell)"
+		}
+	}
+	startupFile, added, err := InstallShellHook(shell)
+	switch {
+	case err != nil:
+		logAt(levelWarn, "Installing the shell hook failed: %v", err)
+		return "failed: " + err.Error()
+	case added:
+		return "added to " + startupFile.TildePath
+	}
+	return "already in " + startupFile.TildePath
+}
+
+// WriteBootstrapSummary writes the summary for humans
+func WriteBootstrapSummary(w io.Writer, summary BootstrapSummary) {
+	repository := "already cloned, pulled"
+	if summary.Cloned {
+		repository = "cloned"
+	}
+	profile := summary.Profile
+	if profile == "" {
+		profile = "none"
+	}
+	fmt.Fprintf(w, "\n✓ config-sync is set up at %s\n", configFolder().TildePath)
+	fmt.Fprintf(w, "  Repository:  %s\n", repository)
+	fmt.Fprintf(w, "  Profile:     %s\n", profile)
+	fmt.Fprintf(w, "  Restored:    %d new, %d replaced, %d already up to date\n", len(summary.Created), len(summary.Replaced), len(summary.Unchanged))
+	if summary.Backups != "" {
+		fmt.Fprintf(w, "  Backups:     %s\n", summary.Backups)
+	}
+	if len(summary.Missing) > 0 {
+		fmt.Fprintf(w, "  Not synced:  %s\n", strings.Join(summary.Missing, ", "))
+	}
+	fmt.Fprintf(w, "  Shell hook:  %s\n", summary.ShellHook)
+}
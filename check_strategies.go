@@ -2,38 +2,34 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
-// TimeoutConfig defines timeouts for different operations
-type TimeoutConfig struct {
-	GitRemote time.Duration // ls-remote (default 5s)
-	GitLocal  time.Duration // status, rev-list, diff (default 2s)
-	FileCopy  time.Duration // per file copy (default 1s)
-	FileStat  time.Duration // file stat checks (default 500ms)
-}
-
-// DefaultTimeouts returns default timeout configuration
-func DefaultTimeouts() TimeoutConfig {
-	return TimeoutConfig{
-		GitRemote: 5 * time.Second,
-		GitLocal:  2 * time.Second,
-		FileCopy:  1 * time.Second,
-		FileStat:  500 * time.Millisecond,
-	}
-}
-
 // TimingLogger logs operation durations and timeouts
+// Every operation is recorded, even when logging is disabled, so it can be reported as data
 type TimingLogger struct {
 	prefix  string
 	enabled bool
 	writer  io.Writer
+	entries []TimingEntry
+}
+
+// TimingEntry is one timed operation
+type TimingEntry struct {
+	Operation string        `json:"operation"`
+	Duration  time.Duration `json:"-"`
+	Ms        int64         `json:"ms"`
+	Error     string        `json:"error,omitempty"`
 }
 
 // NewTimingLogger creates a new timing logger
@@ -47,41 +43,113 @@ func NewTimingLogger(prefix string, enabled bool) *TimingLogger {
 
 // Time runs a function and logs its duration
 func (t *TimingLogger) Time(operation string, fn func() error) error {
-	if !t.enabled {
-		return fn()
-	}
-
 	start := time.Now()
 	err := fn()
-	duration := time.Since(start)
-
-	if err != nil {
-		fmt.Fprintf(t.writer, "%s%s... %dms (error: %v)\n", t.prefix, operation, duration.Milliseconds(), err)
-	} else {
-		fmt.Fprintf(t.writer, "%s%s... %dms\n", t.prefix, operation, duration.Milliseconds())
-	}
+	t.record(operation, time.Since(start), err)
 	return err
 }
 
 // TimeValue runs a function and returns its value along with timing
 func (t *TimingLogger) TimeValue(operation string, fn func() (bool, error)) (bool, error) {
-	if !t.enabled {
-		return fn()
-	}
-
 	start := time.Now()
 	result, err := fn()
-	duration := time.Since(start)
+	t.record(operation, time.Since(start), err)
+	return result, err
+}
 
+// Entries returns every operation timed so far
+func (t *TimingLogger) Entries() []TimingEntry {
+	return t.entries
+}
+
+// WriteTimingsJSON writes every operation timed so far as a JSON array
+func WriteTimingsJSON(w io.Writer, t *TimingLogger) error {
+	entries := t.Entries()
+	if entries == nil {
+		entries = []TimingEntry{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// record stores a timed operation and logs it when enabled
+func (t *TimingLogger) record(operation string, duration time.Duration, err error) {
+	entry := TimingEntry{Operation: operation, Duration: duration, Ms: duration.Milliseconds()}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.entries = append(t.entries, entry)
+
+	if !t.enabled {
+		return
+	}
 	if err != nil {
 		fmt.Fprintf(t.writer, "%s%s... %dms (error: %v)\n", t.prefix, operation, duration.Milliseconds(), err)
 	} else {
 		fmt.Fprintf(t.writer, "%s%s... %dms\n", t.prefix, operation, duration.Milliseconds())
 	}
-	return result, err
 }
 
-// CheckStrategy defines the interface for checking update status
+// Checker defines the interface for checking update status
+type Checker interface {
+	CheckUnsyncedFiles(ctx context.Context) ([]FileStatus, error)
+	CheckUnpushed(ctx context.Context) (bool, error)
+	CheckUnpulled(ctx context.Context) (bool, error)
+	CheckRemotes(ctx context.Context) ([]RemoteStatus, error)
+}
+
+// defaultChecker is used when neither the flag nor the config picks a strategy
+const defaultChecker = "cached-state"
+
+// checkers maps strategy names to constructors
+// Strategies only differ in how they detect unsynced source files, the git checks are shared
+var checkers = map[string]func(base *CheckStrategy) Checker{
+	"hash-compare":   func(base *CheckStrategy) Checker { return &HashCompareChecker{base} },
+	"copy-then-diff": func(base *CheckStrategy) Checker { return &CopyThenDiffChecker{base} },
+	"mtime-size":     func(base *CheckStrategy) Checker { return &MtimeSizeChecker{base} },
+	"cached-state":   func(base *CheckStrategy) Checker { return &CachedStateChecker{base} },
+}
+
+// checkerAliases keeps older strategy names working
+var checkerAliases = map[string]string{
+	"manual": "hash-compare",
+}
+
+// CheckerNames returns the registered strategy names in sorted order
+func CheckerNames() []string {
+	names := make([]string, 0, len(checkers))
+	for name := range checkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewChecker creates the named check strategy
+func NewChecker(name string, git GitRunner, config *JsonConfig, syncDir string, logger *TimingLogger) (Checker, error) {
+	if alias, ok := checkerAliases[name]; ok {
+		name = alias
+	}
+	newChecker, ok := checkers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown check strategy %q (available: %s)", name, strings.Join(CheckerNames(), ", "))
+	}
+	return newChecker(NewCheckStrategy(git, config, syncDir, logger)), nil
+}
+
+// CheckStrategyName picks the check strategy: local.json, then config.json, then the default
+func (c *JsonConfig) CheckStrategyName() string {
+	if local, err := LoadLocalSettings(configFolder()); err == nil && local.Check != "" {
+		return local.Check
+	}
+	if c.Check != "" {
+		return c.Check
+	}
+	return defaultChecker
+}
+
+// CheckStrategy holds the checks shared by every strategy
 type CheckStrategy struct {
 	git      GitRunner
 	config   *JsonConfig
@@ -97,15 +165,15 @@ func NewCheckStrategy(git GitRunner, config *JsonConfig, syncDir string, logger
 		config:   config,
 		syncDir:  syncDir,
 		logger:   logger,
-		timeouts: DefaultTimeouts(),
+		timeouts: appTimeouts,
 	}
 }
 
-func (c *CheckStrategy) CheckUnpushed() (bool, error) {
+func (c *CheckStrategy) CheckUnpushed(ctx context.Context) (bool, error) {
 	var hasChanges bool
 	err := c.logger.Time("Checking for unpushed changes", func() error {
 		// Check git status for uncommitted changes (local, fast)
-		ctx, cancel := context.WithTimeout(context.Background(), c.timeouts.GitLocal)
+		ctx, cancel := timeoutContext(ctx, c.timeouts.GitLocal)
 		defer cancel()
 
 		cmd := exec.CommandContext(ctx, "git", "status", "--porcelain")
@@ -134,8 +202,9 @@ func (c *CheckStrategy) CheckUnpushed() (bool, error) {
 			return nil
 		}
 
+		// Output format: "ahead\tbehind", HEAD is the left side
 		parts := strings.Fields(string(output))
-		if len(parts) >= 2 && parts[1] != "0" {
+		if len(parts) >= 2 && parts[0] != "0" {
 			hasChanges = true
 		}
 		return nil
@@ -143,11 +212,11 @@ func (c *CheckStrategy) CheckUnpushed() (bool, error) {
 	return hasChanges, err
 }
 
-func (c *CheckStrategy) CheckUnpulled() (bool, error) {
+func (c *CheckStrategy) CheckUnpulled(ctx context.Context) (bool, error) {
 	var hasChanges bool
 	err := c.logger.Time("Checking for unpulled changes", func() error {
 		// Get local HEAD (local, fast)
-		ctx, cancel := context.WithTimeout(context.Background(), c.timeouts.GitLocal)
+		ctx, cancel := timeoutContext(ctx, c.timeouts.GitLocal)
 		defer cancel()
 
 		cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
@@ -160,18 +229,20 @@ func (c *CheckStrategy) CheckUnpulled() (bool, error) {
 		localHash := strings.TrimSpace(string(localHead))
 
 		// Get remote HEAD using ls-remote (remote, 5s timeout)
-		ctxRemote, cancelRemote := context.WithTimeout(context.Background(), c.timeouts.GitRemote)
+		ctxRemote, cancelRemote := timeoutContext(ctx, c.timeouts.GitRemote)
 		defer cancelRemote()
 
 		cmd = exec.CommandContext(ctxRemote, "git", "ls-remote", "--heads", "origin", "main")
 		cmd.Dir = c.syncDir
 		remoteHead, err := cmd.Output()
 		if err != nil {
+			if ctx.Err() == context.Canceled {
+				return ctx.Err()
+			}
 			if ctxRemote.Err() == context.DeadlineExceeded {
-				return fmt.Errorf("git ls-remote timeout")
+				return &networkError{fmt.Errorf("git ls-remote timeout")}
 			}
-			// Remote not reachable, can't check
-			return nil
+			return &networkError{fmt.Errorf("%s is unreachable, can't check for remote changes", primaryRemote)}
 		}
 
 		// ls-remote output format: "<hash>\trefs/heads/main"
@@ -190,37 +261,362 @@ func (c *CheckStrategy) CheckUnpulled() (bool, error) {
 	return hasChanges, err
 }
 
-func (c *CheckStrategy) CheckUnsyncedFiles() (bool, error) {
+// HashCompareChecker hashes every tracked source file and its synced copy
+type HashCompareChecker struct {
+	*CheckStrategy
+}
+
+func (c *HashCompareChecker) CheckUnsyncedFiles(ctx context.Context) ([]FileStatus, error) {
+	return c.compareHashes(ctx, "Checking for unsynced source files", fileHash)
+}
+
+// CachedStateChecker answers from the state remembered in ~/.config-sync/.state/
+// Only files whose size or mtime changed since the last run are hashed again,
+// and the remote head is read from the cache instead of running ls-remote
+type CachedStateChecker struct {
+	*CheckStrategy
+}
+
+func (c *CachedStateChecker) CheckUnsyncedFiles(ctx context.Context) ([]FileStatus, error) {
+	cache := LoadStateCache(c.config.folder)
+	files, err := c.compareHashes(ctx, "Checking for unsynced source files (cached)", cache.fileHash)
+
+	// Forget the files of paths that are no longer tracked, so the cache doesn't keep growing
+	var roots []string
+	for _, tildePath := range c.trackedPaths() {
+		roots = append(roots, ShorthandPath{}.New(tildePath).FullPath, filepath.Join(c.syncDir, md5Hash(tildePath)))
+	}
+	cache.Prune(roots)
+	if saveErr := cache.Save(); err == nil {
+		err = saveErr
+	}
+	return files, err
+}
+
+// CheckUnpulled compares the local HEAD with the cached remote head instead of asking the remote
+// A stale cache is refreshed in the background, so the answer may lag by one check
+func (c *CachedStateChecker) CheckUnpulled(ctx context.Context) (bool, error) {
 	var hasChanges bool
-	err := c.logger.Time("Checking for unsynced source files", func() error {
-		for tildePath := range c.config.Files {
+	err := c.logger.Time("Checking for unpulled changes (cached)", func() error {
+		state := LoadRemoteState(configFolder())
+		if !state.Fresh(c.timeouts.RemoteTTL) {
+			if err := refreshRemoteStateInBackground(configFolder(), state, c.timeouts.GitRemote); err != nil {
+				return err
+			}
+		}
+		if state.Unreachable {
+			// The old head is kept, but whether it's still current is unknown
+			return &networkError{fmt.Errorf("%s was unreachable at the last check, can't check for remote changes", primaryRemote)}
+		}
+		if state.Head == "" {
+			// Never checked or remote has no main yet
+			return nil
+		}
+
+		ctx, cancel := timeoutContext(ctx, c.timeouts.GitLocal)
+		defer cancel()
+
+		// Remote head unknown locally means there are new commits to pull
+		cmd := exec.CommandContext(ctx, "git", "cat-file", "-e", state.Head+"^{commit}")
+		cmd.Dir = c.syncDir
+		if cmd.Run() != nil {
+			hasChanges = true
+			return nil
+		}
+
+		// Remote head already part of local history means nothing to pull
+		cmd = exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", state.Head, "HEAD")
+		cmd.Dir = c.syncDir
+		hasChanges = cmd.Run() != nil
+		return nil
+	})
+	return hasChanges, err
+}
+
+// compareHashes compares each tracked path with its synced copy, hashing every file with the given function
+// The files of all tracked paths are hashed in parallel
+func (c *CheckStrategy) compareHashes(ctx context.Context, operation string, hash func(string) (string, error)) ([]FileStatus, error) {
+	var files []FileStatus
+	err := c.logger.Time(operation, func() error {
+		paths := c.trackedPaths()
+
+		// Source and synced copy of each tracked path, side by side
+		targets := make([]string, 0, 2*len(paths))
+		for _, tildePath := range paths {
 			srcPath := ShorthandPath{}.New(tildePath)
+			syncedPath := filepath.Join(c.syncDir, md5Hash(tildePath), filepath.Base(srcPath.FullPath))
+			targets = append(targets, srcPath.FullPath, syncedPath)
+		}
+		hashes, errs := hashPaths(ctx, targets, hash)
 
-			// Get source file hash
-			srcHash, err := fileHash(srcPath.FullPath)
-			if err != nil {
+		for i, tildePath := range paths {
+			srcHash, srcErr := hashes[2*i], errs[2*i]
+			syncedHash, syncedErr := hashes[2*i+1], errs[2*i+1]
+			switch {
+			case srcErr != nil:
 				// Source file doesn't exist or unreadable
-				continue
+				files = append(files, FileStatus{Path: tildePath, Status: FileMissing})
+			case syncedErr != nil:
+				// Synced file doesn't exist - file is new
+				files = append(files, FileStatus{Path: tildePath, Status: FileNew})
+			case srcHash != syncedHash:
+				files = append(files, FileStatus{Path: tildePath, Status: FileModified})
+			default:
+				files = append(files, FileStatus{Path: tildePath, Status: FileInSync})
 			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// trackedPaths returns the tracked paths in sorted order, so results are stable
+func (c *CheckStrategy) trackedPaths() []string {
+	return c.config.trackedPaths()
+}
 
-			// Get synced file hash
+// CopyThenDiffChecker copies every tracked path into a temporary synced-files layout
+// and lets `git diff --no-index --quiet` compare it with the real one
+type CopyThenDiffChecker struct {
+	*CheckStrategy
+}
+
+func (c *CopyThenDiffChecker) CheckUnsyncedFiles(ctx context.Context) ([]FileStatus, error) {
+	var files []FileStatus
+	err := c.logger.Time("Checking for unsynced source files (copy-then-diff)", func() error {
+		tmpDir, err := os.MkdirTemp("", "config-sync-check-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+
+		statuses := make(map[string]string)
+		for _, tildePath := range c.trackedPaths() {
+			srcPath := ShorthandPath{}.New(tildePath)
 			hash := md5Hash(tildePath)
-			baseName := filepath.Base(srcPath.FullPath)
-			syncedPath := filepath.Join(c.syncDir, hash, baseName)
+			destPath := filepath.Join(tmpDir, hash, filepath.Base(srcPath.FullPath))
 
-			syncedHash, err := fileHash(syncedPath)
+			srcInfo, err := os.Stat(srcPath.FullPath)
 			if err != nil {
-				// Synced file doesn't exist - file is new
-				hasChanges = true
+				// Missing sources count as unchanged, keep the synced copy as-is
+				statuses[hash] = FileMissing
+				if _, err := os.Stat(filepath.Join(c.syncDir, hash)); err == nil {
+					if err := copyDir(ctx, filepath.Join(c.syncDir, hash), filepath.Join(tmpDir, hash)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			statuses[hash] = FileInSync
+			if _, err := os.Stat(filepath.Join(c.syncDir, hash)); err != nil {
+				statuses[hash] = FileNew
+			}
+
+			if srcInfo.IsDir() {
+				err = copyDir(ctx, srcPath.FullPath, destPath)
+			} else if err = os.MkdirAll(filepath.Dir(destPath), 0755); err == nil {
+				err = copyFile(ctx, srcPath.FullPath, destPath)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %w", tildePath, err)
 			}
+		}
+
+		ctx, cancel := timeoutContext(ctx, c.timeouts.GitLocal)
+		defer cancel()
 
-			// Compare hashes
-			if srcHash != syncedHash {
-				hasChanges = true
-				return nil
+		cmd := exec.CommandContext(ctx, "git", "diff", "--no-index", "--name-only", "--", c.syncDir, tmpDir)
+		output, err := cmd.Output()
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("git diff timeout")
+		}
+
+		// Exit code 1 means the trees differ, each changed file is listed under one of the two roots
+		var exitErr *exec.ExitError
+		if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+			return err
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			hash := diffEntryHash(line, c.syncDir, tmpDir)
+			if statuses[hash] == FileInSync {
+				statuses[hash] = FileModified
 			}
 		}
+
+		for _, tildePath := range c.trackedPaths() {
+			files = append(files, FileStatus{Path: tildePath, Status: statuses[md5Hash(tildePath)]})
+		}
 		return nil
 	})
-	return hasChanges, err
+	return files, err
+}
+
+// diffEntryHash returns the synced-files hash folder a `git diff --name-only` line belongs to
+func diffEntryHash(line string, roots ...string) string {
+	line = "/" + strings.TrimPrefix(strings.TrimSpace(line), "/")
+	for _, root := range roots {
+		root = "/" + strings.Trim(filepath.ToSlash(root), "/") + "/"
+		if rest, found := strings.CutPrefix(line, root); found {
+			hash, _, _ := strings.Cut(rest, "/")
+			return hash
+		}
+	}
+	return ""
+}
+
+// MtimeSizeChecker compares sizes and modification times without reading file contents
+// Relies on copyFile keeping mtimes, so a synced copy has the same mtime as its source
+type MtimeSizeChecker struct {
+	*CheckStrategy
+}
+
+func (c *MtimeSizeChecker) CheckUnsyncedFiles(ctx context.Context) ([]FileStatus, error) {
+	var files []FileStatus
+	err := c.logger.Time("Checking for unsynced source files (mtime/size)", func() error {
+		for _, tildePath := range c.trackedPaths() {
+			srcPath := ShorthandPath{}.New(tildePath)
+			if _, err := os.Stat(srcPath.FullPath); err != nil {
+				// Source file doesn't exist or unreadable
+				files = append(files, FileStatus{Path: tildePath, Status: FileMissing})
+				continue
+			}
+
+			syncedPath := filepath.Join(c.syncDir, md5Hash(tildePath), filepath.Base(srcPath.FullPath))
+			switch {
+			case !pathExists(syncedPath):
+				files = append(files, FileStatus{Path: tildePath, Status: FileNew})
+			case !sameStats(srcPath.FullPath, syncedPath):
+				files = append(files, FileStatus{Path: tildePath, Status: FileModified})
+			default:
+				files = append(files, FileStatus{Path: tildePath, Status: FileInSync})
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// pathExists reports whether a file or directory exists
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// sameStats reports whether two files or directories have the same files with the same sizes and mtimes
+func sameStats(src, synced string) bool {
+	srcFiles, err := statTree(src)
+	if err != nil {
+		return false
+	}
+	syncedFiles, err := statTree(synced)
+	if err != nil || len(srcFiles) != len(syncedFiles) {
+		return false
+	}
+
+	for rel, srcInfo := range srcFiles {
+		syncedInfo, ok := syncedFiles[rel]
+		if !ok || srcInfo.Size() != syncedInfo.Size() || !srcInfo.ModTime().Equal(syncedInfo.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// statTree returns the file info of a file, or of every file in a directory keyed by relative path
+func statTree(root string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		files[rel] = info
+		return nil
+	})
+	return files, err
+}
+
+// CheckRemotes compares the local HEAD with main on every remote, all remotes are queried concurrently
+func (c *CheckStrategy) CheckRemotes(ctx context.Context) ([]RemoteStatus, error) {
+	var statuses []RemoteStatus
+	err := c.logger.Time("Checking remotes", func() error {
+		remotes, err := c.git.Remotes(ctx)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := timeoutContext(ctx, c.timeouts.GitLocal)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+		cmd.Dir = c.syncDir
+		localHead, err := cmd.Output()
+		if err != nil {
+			// No commits yet
+			return nil
+		}
+		localHash := strings.TrimSpace(string(localHead))
+
+		statuses = make([]RemoteStatus, len(remotes))
+		var wg sync.WaitGroup
+		for i, remote := range remotes {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				head, err := c.git.RemoteHead(ctx, name)
+				statuses[i] = RemoteStatus{
+					Name:      name,
+					Reachable: err == nil,
+					InSync:    err == nil && head == localHash,
+				}
+			}(i, remote.Name)
+		}
+		wg.Wait()
+		return nil
+	})
+	return statuses, err
+}
+
+// CheckerTiming is how long one check strategy took on the user's tracked files
+type CheckerTiming struct {
+	Name     string
+	Average  time.Duration
+	Unsynced bool
+	Err      error
+}
+
+// TimeCheckers runs CheckUnsyncedFiles of every registered strategy and averages the durations,
+// for check-updates --benchmark: which strategy is fastest depends on the user's own files and disk,
+// the Benchmark functions in check_strategies_test.go only cover a generated tree
+// cached-state gets one untimed warm-up run, since its first run is a plain hash-compare
+func TimeCheckers(ctx context.Context, git GitRunner, config *JsonConfig, syncDir string, runs int) []CheckerTiming {
+	logger := NewTimingLogger("", false)
+
+	var results []CheckerTiming
+	for _, name := range CheckerNames() {
+		result := CheckerTiming{Name: name}
+		checker, _ := NewChecker(name, git, config, syncDir, logger)
+		if name == "cached-state" {
+			checker.CheckUnsyncedFiles(ctx)
+		}
+
+		var total time.Duration
+		for i := 0; i < runs && result.Err == nil; i++ {
+			start := time.Now()
+			var files []FileStatus
+			files, result.Err = checker.CheckUnsyncedFiles(ctx)
+			result.Unsynced = anyUnsynced(files)
+			total += time.Since(start)
+		}
+		result.Average = total / time.Duration(runs)
+		results = append(results, result)
+	}
+	return results
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkerEnv tracks a generated tree of files in a test config folder and syncs it
+func checkerEnv(tb testing.TB, files int) (*testEnv, *JsonConfig, []string) {
+	tb.Helper()
+	env := newTestEnv(tb)
+	env.mustRun("init")
+	paths := writeTree(tb, filepath.Join(env.home, ".config", "bench"), files)
+	env.mustRun("track", "~/.config/bench")
+
+	resetCommandState()
+	config := &JsonConfig{}
+	if err := config.Initialize(ShorthandPath{}.New(env.folder)); err != nil {
+		tb.Fatal(err)
+	}
+	setLogSink(io.Discard)
+	tb.Cleanup(func() { setLogSink(os.Stderr) })
+	if err := config.SyncFiles(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return env, config, paths
+}
+
+func TestCheckersFindChanges(t *testing.T) {
+	env, config, paths := checkerEnv(t, 200)
+	syncDir := filepath.Join(env.folder, "synced-files")
+	ctx := context.Background()
+
+	for _, name := range CheckerNames() {
+		t.Run(name, func(t *testing.T) {
+			checker, err := NewChecker(name, NewGitRunner(), config, syncDir, NewTimingLogger("", false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := checker.CheckUnsyncedFiles(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if anyUnsynced(files) {
+				t.Errorf("unsynced right after SyncFiles: %v", files)
+			}
+
+			// A different size, so mtime-size sees it within the same second too
+			original, _ := os.ReadFile(paths[42])
+			info, _ := os.Stat(paths[42])
+			os.WriteFile(paths[42], append(original, "set changed\n"...), 0644)
+			defer func() {
+				// Put back the synced state for the next strategy, mtime included
+				os.WriteFile(paths[42], original, 0644)
+				os.Chtimes(paths[42], info.ModTime(), info.ModTime())
+			}()
+
+			files, err = checker.CheckUnsyncedFiles(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !anyUnsynced(files) {
+				t.Errorf("no unsynced files after editing %s", paths[42])
+			}
+		})
+	}
+}
+
+// benchmarkChecker times one strategy on a synced tree of benchmarkFiles files
+func benchmarkChecker(b *testing.B, name string) {
+	env, config, _ := checkerEnv(b, benchmarkFiles)
+	checker, err := NewChecker(name, NewGitRunner(), config, filepath.Join(env.folder, "synced-files"), NewTimingLogger("", false))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	// Fills the cache of cached-state, which would otherwise time a plain hash-compare
+	checker.CheckUnsyncedFiles(ctx)
+
+	for b.Loop() {
+		if _, err := checker.CheckUnsyncedFiles(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHashCompareChecker(b *testing.B)  { benchmarkChecker(b, "hash-compare") }
+func BenchmarkCopyThenDiffChecker(b *testing.B) { benchmarkChecker(b, "copy-then-diff") }
+func BenchmarkMtimeSizeChecker(b *testing.B)    { benchmarkChecker(b, "mtime-size") }
+func BenchmarkCachedStateChecker(b *testing.B)  { benchmarkChecker(b, "cached-state") }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+)
+
+// ChangeSummary lists the tracked paths touched by a staged commit
+type ChangeSummary struct {
+	Added    []string
+	Modified []string
+	Deleted  []string
+	Other    []string // staged paths that don't belong to a tracked entry (config.json, .gitignore, ...)
+}
+
+// IsEmpty reports whether nothing is staged
+func (s ChangeSummary) IsEmpty() bool {
+	return len(s.Added)+len(s.Modified)+len(s.Deleted)+len(s.Other) == 0
+}
+
+// TrackedCount returns the number of tracked paths in the summary
+func (s ChangeSummary) TrackedCount() int {
+	return len(s.Added) + len(s.Modified) + len(s.Deleted)
+}
+
+// SummarizeStagedChanges maps the staged synced-files/<md5> changes back to tracked paths
+// Deleted entries are resolved against the config.json of the last commit
+func (c *JsonConfig) SummarizeStagedChanges(ctx context.Context, git GitRunner) (ChangeSummary, error) {
+	var summary ChangeSummary
+	if err := c.checkInitialized(); err != nil {
+		return summary, err
+	}
+
+	staged, err := git.StagedChanges(ctx)
+	if err != nil {
+		return summary, err
+	}
+
+	// Previous config, empty on the first commit
+	var previous JsonConfig
+	if content, err := git.ReadFileAt(ctx, "HEAD", "config.json"); err == nil {
+		json.Unmarshal(content, &previous)
+	}
+
+	current := make(map[string]string)
+	for tildePath := range c.Files {
+		current[md5Hash(tildePath)] = tildePath
+	}
+	before := make(map[string]string)
+	for tildePath := range previous.Files {
+		before[md5Hash(tildePath)] = tildePath
+	}
+
+	seen := make(map[string]bool)
+	for path := range staged {
+		rest, found := strings.CutPrefix(path, "synced-files/")
+		if !found {
+			summary.Other = append(summary.Other, path)
+			continue
+		}
+		hash, _, _ := strings.Cut(rest, "/")
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		tildePath, tracked := current[hash]
+		_, wasTracked := before[hash]
+		switch {
+		case tracked && wasTracked:
+			summary.Modified = append(summary.Modified, tildePath)
+		case tracked:
+			summary.Added = append(summary.Added, tildePath)
+		case wasTracked:
+			summary.Deleted = append(summary.Deleted, before[hash])
+		default:
+			summary.Other = append(summary.Other, "synced-files/"+hash)
+		}
+	}
+
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Modified)
+	sort.Strings(summary.Deleted)
+	sort.Strings(summary.Other)
+	return summary, nil
+}
+
+// BuildCommitMessage creates the push commit message from the staged changes
+// A user-supplied message replaces the generated subject, the change list and trailers are always added
+func BuildCommitMessage(summary ChangeSummary, userMessage string) string {
+	var b strings.Builder
+
+	if userMessage != "" {
+		b.WriteString(strings.TrimSpace(userMessage))
+	} else {
+		b.WriteString(commitSubject(summary))
+	}
+	b.WriteString("\n")
+
+	sections := []struct {
+		title string
+		paths []string
+	}{
+		{"Added", summary.Added},
+		{"Modified", summary.Modified},
+		{"Deleted", summary.Deleted},
+	}
+	for _, section := range sections {
+		if len(section.paths) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", section.title)
+		for _, path := range section.paths {
+			fmt.Fprintf(&b, "  %s\n", path)
+		}
+	}
+
+	b.WriteString("\n")
+	for _, trailer := range commitTrailers() {
+		b.WriteString(trailer + "\n")
+	}
+
+	return b.String()
+}
+
+// commitSubject summarizes the changes in one line
+func commitSubject(summary ChangeSummary) string {
+	switch {
+	case summary.TrackedCount() == 0:
+		return "config-sync: update config"
+	case summary.TrackedCount() > 1:
+		return fmt.Sprintf("config-sync: update %d tracked paths", summary.TrackedCount())
+	case len(summary.Added) == 1:
+		return "config-sync: add " + summary.Added[0]
+	case len(summary.Deleted) == 1:
+		return "config-sync: remove " + summary.Deleted[0]
+	default:
+		return "config-sync: update " + summary.Modified[0]
+	}
+}
+
+// commitTrailers returns the git trailers identifying where a commit was made
+func commitTrailers() []string {
+	var trailers []string
+
+	if host, err := os.Hostname(); err == nil {
+		trailers = append(trailers, "Host: "+host)
+	}
+	if currentUser, err := user.Current(); err == nil {
+		trailers = append(trailers, "User: "+currentUser.Username)
+	}
+	if profile := activeProfile(); profile != "" {
+		trailers = append(trailers, "Profile: "+profile)
+	}
+	trailers = append(trailers, "Config-Sync-Version: "+Version)
+
+	return trailers
+}
+
+// activeProfile returns the profile this machine syncs as, from CONFIG_SYNC_PROFILE or else local.json
+func activeProfile() string {
+	if profile := strings.TrimSpace(os.Getenv("CONFIG_SYNC_PROFILE")); profile != "" {
+		return profile
+	}
+	settings, _ := LoadLocalSettings(configFolder())
+	return settings.Profile
+}
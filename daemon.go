@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// daemonUnitName names the systemd units and marks the crontab entry
+// Every config folder other than the default one gets its own, so separate repositories sync on their own
+func daemonUnitName() string {
+	if !customConfigFolder() {
+		return "config-sync"
+	}
+	return "config-sync-" + md5Hash(configFolder().FullPath)[:8]
+}
+
+// defaultDaemonInterval is how often the daemon syncs unless --interval says otherwise
+const defaultDaemonInterval = 15 * time.Minute
+
+// maxDaemonLogSize is the log size at which the daemon log is rotated to daemon.log.1
+const maxDaemonLogSize = 1 << 20
+
+// daemonMethods are the supported service managers, auto picks systemd when it's running
+var daemonMethods = []string{"auto", "systemd", "cron"}
+
+// DaemonJob is the periodic sync a service manager runs
+type DaemonJob struct {
+	Executable string
+	Interval   time.Duration
+	LogFile    string
+	Home       string // Config folder passed with --home, empty for the default one
+}
+
+// NewDaemonJob creates the job for this executable and the default log file
+func NewDaemonJob(interval time.Duration) (DaemonJob, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return DaemonJob{}, fmt.Errorf("finding the config-sync executable failed: %w", err)
+	}
+	job := DaemonJob{Executable: executable, Interval: interval, LogFile: daemonLogPath(configFolder())}
+	if customConfigFolder() {
+		job.Home = configFolder().FullPath
+	}
+	return job, nil
+}
+
+// args is the command line the service manager runs
+func (j DaemonJob) args() []string {
+	args := []string{j.Executable, "daemon", "run", "--log-file", j.LogFile}
+	if j.Home != "" {
+		args = append(args, "--home", j.Home)
+	}
+	return args
+}
+
+// daemonLogPath is where scheduled runs log to
+func daemonLogPath(folder ShorthandPath) string {
+	return folder.Suffix(filepath.Join(".state", "daemon.log")).FullPath
+}
+
+// scheduler installs the daemon job into a service manager
+type scheduler interface {
+	Name() string
+	Install(job DaemonJob) error
+	Uninstall() error
+	Installed() bool
+	Status() string
+}
+
+// newScheduler returns the scheduler for a method
+// With root set, units and crontab are only written below root, nothing is started,
+// so the generated files can be inspected without systemd or cron
+func newScheduler(method, root string) (scheduler, error) {
+	if method == "auto" {
+		method = "cron"
+		if root != "" || systemdAvailable() {
+			method = "systemd"
+		}
+	}
+
+	switch method {
+	case "systemd":
+		if root != "" {
+			return systemdScheduler{unitDir: root}, nil
+		}
+		return systemdScheduler{unitDir: systemdUserDir(), systemctl: true}, nil
+	case "cron":
+		if root != "" {
+			return cronScheduler{crontabFile: filepath.Join(root, "crontab")}, nil
+		}
+		return cronScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("unknown method %q (available: %s)", method, strings.Join(daemonMethods, ", "))
+	}
+}
+
+// installedScheduler finds the scheduler the daemon is installed with
+// With method auto every method is checked, so uninstall works whichever one install picked
+func installedScheduler(method, root string) (scheduler, error) {
+	if method != "auto" {
+		return newScheduler(method, root)
+	}
+	for _, candidate := range daemonMethods[1:] {
+		s, err := newScheduler(candidate, root)
+		if err == nil && s.Installed() {
+			return s, nil
+		}
+	}
+	return newScheduler(method, root)
+}
+
+// systemdAvailable reports whether a systemd user instance is running
+func systemdAvailable() bool {
+	return exec.Command("systemctl", "--user", "show-environment").Run() == nil
+}
+
+// systemdUserDir is where systemd looks for user units
+func systemdUserDir() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = ShorthandPath{}.New("~/.config").FullPath
+	}
+	return filepath.Join(configHome, "systemd", "user")
+}
+
+// systemdScheduler runs the job from a systemd user timer and a oneshot service
+type systemdScheduler struct {
+	unitDir   string
+	systemctl bool // False only writes the unit files
+}
+
+func (s systemdScheduler) Name() string { return "systemd" }
+
+// units returns the service and timer unit files by name
+func (s systemdScheduler) units(job DaemonJob) map[string]string {
+	quoted := make([]string, len(job.args()))
+	for i, arg := range job.args() {
+		quoted[i] = strconv.Quote(arg)
+	}
+
+	service := "[Unit]\n" +
+		"Description=Pull and push tracked config files with config-sync\n\n" +
+		"[Service]\n" +
+		"Type=oneshot\n" +
+		"ExecStart=" + strings.Join(quoted, " ") + "\n"
+
+	timer := "[Unit]\n" +
+		"Description=Run config-sync every " + job.Interval.String() + "\n\n" +
+		"[Timer]\n" +
+		"OnBootSec=2min\n" +
+		fmt.Sprintf("OnUnitActiveSec=%ds\n", int(job.Interval.Seconds())) +
+		"RandomizedDelaySec=30s\n\n" +
+		"[Install]\n" +
+		"WantedBy=timers.target\n"
+
+	return map[string]string{
+		daemonUnitName() + ".service": service,
+		daemonUnitName() + ".timer":   timer,
+	}
+}
+
+func (s systemdScheduler) Install(job DaemonJob) error {
+	if err := os.MkdirAll(s.unitDir, 0755); err != nil {
+		return err
+	}
+	for name, content := range s.units(job) {
+		if err := os.WriteFile(filepath.Join(s.unitDir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	if !s.systemctl {
+		return nil
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", daemonUnitName()+".timer")
+}
+
+func (s systemdScheduler) Uninstall() error {
+	if s.systemctl {
+		// Fails when it was never enabled, the files are removed either way
+		systemctl("disable", "--now", daemonUnitName()+".timer")
+	}
+	for _, name := range []string{daemonUnitName() + ".service", daemonUnitName() + ".timer"} {
+		if err := os.Remove(filepath.Join(s.unitDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.systemctl {
+		return systemctl("daemon-reload")
+	}
+	return nil
+}
+
+func (s systemdScheduler) Installed() bool {
+	_, err := os.Stat(filepath.Join(s.unitDir, daemonUnitName()+".timer"))
+	return err == nil
+}
+
+func (s systemdScheduler) Status() string {
+	if !s.Installed() {
+		return "not installed"
+	}
+	if !s.systemctl {
+		return "units written to " + s.unitDir
+	}
+	active, _ := exec.Command("systemctl", "--user", "is-active", daemonUnitName()+".timer").Output()
+	return "timer " + strings.TrimSpace(string(active))
+}
+
+// systemctl runs a systemctl --user command
+func systemctl(args ...string) error {
+	output, err := exec.Command("systemctl", append([]string{"--user"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// cronMarkers enclose the daemon's entry, so it can be replaced without touching other jobs
+func cronMarkers() [2]string {
+	return [2]string{"# BEGIN " + daemonUnitName() + " daemon", "# END " + daemonUnitName() + " daemon"}
+}
+
+// cronScheduler runs the job from the user's crontab
+type cronScheduler struct {
+	crontabFile string // Edited instead of the user's crontab when set
+}
+
+func (c cronScheduler) Name() string { return "cron" }
+
+// cronSchedule turns an interval into a cron schedule
+// Cron can only express intervals that evenly divide an hour or a day
+func cronSchedule(interval time.Duration) (string, error) {
+	minutes := int(interval.Minutes())
+	switch {
+	case interval%time.Minute != 0 || minutes < 1:
+		return "", fmt.Errorf("cron intervals must be whole minutes, got %s", interval)
+	case minutes < 60 && 60%minutes == 0:
+		return fmt.Sprintf("*/%d * * * *", minutes), nil
+	case minutes%60 == 0 && 24%(minutes/60) == 0:
+		return fmt.Sprintf("0 */%d * * *", minutes/60), nil
+	default:
+		return "", fmt.Errorf("cron can't run every %s, use an interval that divides an hour or a day", interval)
+	}
+}
+
+// cronEntry returns the daemon's crontab block
+func (c cronScheduler) cronEntry(job DaemonJob) (string, error) {
+	schedule, err := cronSchedule(job.Interval)
+	if err != nil {
+		return "", err
+	}
+	quoted := make([]string, len(job.args()))
+	for i, arg := range job.args() {
+		quoted[i] = shellQuote(arg)
+	}
+	return cronMarkers()[0] + "\n" + schedule + " " + strings.Join(quoted, " ") + "\n" + cronMarkers()[1] + "\n", nil
+}
+
+// withCronEntry replaces the daemon's block in a crontab, an empty entry removes it
+func withCronEntry(crontab, entry string) string {
+	var kept []string
+	inside := false
+	for _, line := range strings.Split(strings.TrimRight(crontab, "\n"), "\n") {
+		switch {
+		case line == cronMarkers()[0]:
+			inside = true
+		case line == cronMarkers()[1]:
+			inside = false
+		case !inside && line != "":
+			kept = append(kept, line)
+		}
+	}
+
+	result := strings.Join(kept, "\n")
+	if result != "" {
+		result += "\n"
+	}
+	return result + entry
+}
+
+func (c cronScheduler) read() (string, error) {
+	if c.crontabFile != "" {
+		content, err := os.ReadFile(c.crontabFile)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return string(content), err
+	}
+
+	output, err := exec.Command("crontab", "-l").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// crontab -l fails when the user has no crontab yet
+		return "", nil
+	}
+	return string(output), err
+}
+
+func (c cronScheduler) write(content string) error {
+	if c.crontabFile != "" {
+		if err := os.MkdirAll(filepath.Dir(c.crontabFile), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(c.crontabFile, []byte(content), 0644)
+	}
+
+	cmd := exec.Command("crontab", "-")
+	cmd.Stdin = strings.NewReader(content)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("crontab failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (c cronScheduler) Install(job DaemonJob) error {
+	entry, err := c.cronEntry(job)
+	if err != nil {
+		return err
+	}
+	crontab, err := c.read()
+	if err != nil {
+		return err
+	}
+	return c.write(withCronEntry(crontab, entry))
+}
+
+func (c cronScheduler) Uninstall() error {
+	crontab, err := c.read()
+	if err != nil {
+		return err
+	}
+	return c.write(withCronEntry(crontab, ""))
+}
+
+func (c cronScheduler) Installed() bool {
+	crontab, err := c.read()
+	return err == nil && strings.Contains(crontab, cronMarkers()[0])
+}
+
+func (c cronScheduler) Status() string {
+	if !c.Installed() {
+		return "not installed"
+	}
+	crontab, _ := c.read()
+	lines := strings.Split(crontab, "\n")
+	for i, line := range lines {
+		if line == cronMarkers()[0] && i+1 < len(lines) {
+			return "installed: " + lines[i+1]
+		}
+	}
+	return "installed"
+}
+
+// Results of a daemon run
+const (
+	DaemonOK       = "ok"
+	DaemonConflict = "conflict"
+	DaemonOffline  = "offline" // Remote unreachable, retried on the next run
+	DaemonFailed   = "failed"
+	DaemonSkipped  = "skipped" // A watch or another config-sync run is using the repository
+)
+
+// DaemonState is the outcome of the last daemon run, stored in .state/daemon.json
+type DaemonState struct {
+	LastRun time.Time `json:"last_run"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func daemonStatePath(folder ShorthandPath) string {
+	return folder.Suffix(filepath.Join(".state", "daemon.json")).FullPath
+}
+
+// LoadDaemonState reads the outcome of the last daemon run, an empty state means it never ran
+func LoadDaemonState(folder ShorthandPath) DaemonState {
+	var state DaemonState
+	if content, err := os.ReadFile(daemonStatePath(folder)); err == nil {
+		json.Unmarshal(content, &state)
+	}
+	return state
+}
+
+// Save writes the daemon state to the config folder
+func (d DaemonState) Save(folder ShorthandPath) error {
+	if err := ensureLocalIgnores(folder); err != nil {
+		return err
+	}
+	path := daemonStatePath(folder)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	content, _ := json.Marshal(d)
+	return os.WriteFile(path, content, 0600)
+}
+
+// RunDaemonCycle runs one scheduled sync and records its outcome
+// A new merge conflict is reported through the notifier, once rather than on every run
+func RunDaemonCycle(ctx context.Context, config *JsonConfig, notifier Notifier) error {
+	previous := LoadDaemonState(config.folder)
+	state := DaemonState{LastRun: time.Now(), Result: DaemonOK}
+
+	var err error
+	if watch, watchErr := QueryWatchStatus(config.folder); watchErr == nil {
+		state.Result = DaemonSkipped
+		log.Printf("Watch is running (pid %d), skipping scheduled sync\n", watch.PID)
+	} else {
+		err = syncCycle(ctx, config, nil)
+	}
+
+	var conflict *conflictError
+	var netErr *networkError
+	switch {
+	case err == nil:
+	case errors.As(err, &conflict):
+		state.Result = DaemonConflict
+		if previous.Result != DaemonConflict {
+			if notifyErr := notifier.Notify(conflictTitle, conflictMessage()); notifyErr != nil {
+				log.Printf("Notification failed: %v\n", notifyErr)
+			}
+		}
+	case errors.As(err, &netErr):
+		state.Result = DaemonOffline
+	case errors.Is(err, errRepoBusy):
+		state.Result = DaemonSkipped
+	default:
+		state.Result = DaemonFailed
+	}
+	if err != nil {
+		state.Error = err.Error()
+		log.Printf("Scheduled sync %s: %v\n", state.Result, err)
+	} else if state.Result == DaemonOK {
+		log.Println("Scheduled sync completed")
+	}
+
+	if saveErr := state.Save(config.folder); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// openDaemonLog sends the log and git output to the daemon log file, rotating it when it grows too big
+func openDaemonLog(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > maxDaemonLogSize {
+		os.Rename(path, path+".1")
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	setLogSink(file)
+	os.Stdout = file
+	os.Stderr = file
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenJob is a job with fixed paths, so the generated files don't depend on the machine
+var goldenJob = DaemonJob{
+	Executable: "/usr/local/bin/config-sync",
+	Interval:   defaultDaemonInterval,
+	LogFile:    "/home/user/.config-sync/.state/daemon.log",
+}
+
+// assertGolden compares every file written below root with testdata/daemon/<name>
+func assertGolden(t *testing.T, root, name string) {
+	t.Helper()
+	golden := filepath.Join("testdata", "daemon", name)
+	if *update {
+		os.RemoveAll(golden)
+		if err := os.CopyFS(golden, os.DirFS(root)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadDir(golden)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to create it", err)
+	}
+	got, _ := os.ReadDir(root)
+	if len(got) != len(want) {
+		t.Errorf("wrote %d files, golden %s has %d", len(got), golden, len(want))
+	}
+	for _, entry := range want {
+		wantContent, _ := os.ReadFile(filepath.Join(golden, entry.Name()))
+		gotContent, err := os.ReadFile(filepath.Join(root, entry.Name()))
+		if err != nil {
+			t.Errorf("%s wasn't written: %v", entry.Name(), err)
+			continue
+		}
+		if string(gotContent) != string(wantContent) {
+			t.Errorf("%s differs from %s:\n--- got\n%s--- want\n%s", entry.Name(), golden, gotContent, wantContent)
+		}
+	}
+}
+
+// useConfigFolder makes folder the config folder for the rest of the test
+func useConfigFolder(t *testing.T, folder string) {
+	t.Setenv("CONFIG_SYNC_HOME", "")
+	configHome = folder
+	t.Cleanup(func() { configHome = "" })
+}
+
+func TestDaemonGoldenFiles(t *testing.T) {
+	newTestEnv(t)
+	team := goldenJob
+	team.Home = "/srv/config-sync-team"
+
+	tests := []struct {
+		name   string
+		method string
+		folder string
+		job    DaemonJob
+		before string // Existing crontab
+	}{
+		{"systemd", "systemd", defaultConfigFolder, goldenJob, ""},
+		{"systemd-home", "systemd", team.Home, team, ""},
+		{"cron", "cron", defaultConfigFolder, goldenJob, "0 3 * * * /usr/local/bin/backup\n"},
+		{"cron-home", "cron", team.Home, team, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfigFolder(t, tt.folder)
+			root := t.TempDir()
+			if tt.before != "" {
+				os.WriteFile(filepath.Join(root, "crontab"), []byte(tt.before), 0644)
+			}
+			scheduler, err := newScheduler(tt.method, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := scheduler.Install(tt.job); err != nil {
+				t.Fatal(err)
+			}
+			// Installing again replaces the job rather than adding a second one
+			if err := scheduler.Install(tt.job); err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, root, tt.name)
+
+			if err := scheduler.Uninstall(); err != nil {
+				t.Fatal(err)
+			}
+			if scheduler.Installed() {
+				t.Error("still installed after Uninstall")
+			}
+			if tt.method == "cron" {
+				crontab, _ := os.ReadFile(filepath.Join(root, "crontab"))
+				if string(crontab) != tt.before {
+					t.Errorf("crontab after Uninstall = %q, want %q", crontab, tt.before)
+				}
+			}
+		})
+	}
+}
+
+func TestDaemonInstallHome(t *testing.T) {
+	env := newTestEnv(t)
+	env.setup()
+	root := t.TempDir()
+	env.mustRun("daemon", "install", "--method", "systemd", "--root", root)
+
+	resetCommandState()
+	unit := daemonUnitName()
+	if unit == "config-sync" {
+		t.Fatalf("a CONFIG_SYNC_HOME folder uses the default unit name")
+	}
+	service, err := os.ReadFile(filepath.Join(root, unit+".service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"--home" ` + `"` + env.folder + `"`; !strings.Contains(string(service), want) {
+		t.Errorf("%s.service doesn't pass %s:\n%s", unit, want, service)
+	}
+}
+
+// recordingNotifier keeps the notifications instead of sending them
+type recordingNotifier struct {
+	sent []string
+}
+
+func (n *recordingNotifier) Notify(title, message string) error {
+	n.sent = append(n.sent, title)
+	return nil
+}
+
+// daemonCycle runs one scheduled sync against the test config folder
+func daemonCycle(t *testing.T, env *testEnv, notifier Notifier) (DaemonState, error) {
+	t.Helper()
+	resetCommandState()
+	var config JsonConfig
+	if err := config.Initialize(ShorthandPath{}.New(env.folder)); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	setLogSink(&logs)
+	defer setLogSink(os.Stderr)
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("daemon log:\n%s", logs.String())
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := RunDaemonCycle(ctx, &config, notifier)
+	return LoadDaemonState(config.folder), err
+}
+
+func TestDaemonCycleMarkerLines(t *testing.T) {
+	env := newTestEnv(t)
+	env.setup()
+	// Setext headings and reStructuredText titles look like conflict markers
+	notes := env.writeHome("notes.md", "Notes\n=======\n\nfirst\n")
+	env.mustRun("track", notes)
+	env.mustRun("push")
+
+	env.pushFromOther(notes, "Notes\n=======\n\nfirst\n\nMore\n=======\n")
+
+	notifier := &recordingNotifier{}
+	state, err := daemonCycle(t, env, notifier)
+	if err != nil {
+		t.Fatalf("RunDaemonCycle: %v", err)
+	}
+	if state.Result != DaemonOK {
+		t.Errorf("Result = %s, want %s", state.Result, DaemonOK)
+	}
+	if len(notifier.sent) > 0 {
+		t.Errorf("sent %v for a clean repository", notifier.sent)
+	}
+	content, _ := os.ReadFile(filepath.Join(env.home, "notes.md"))
+	if string(content) != "Notes\n=======\n\nfirst\n\nMore\n=======\n" {
+		t.Errorf("notes.md wasn't restored from the pull:\n%s", content)
+	}
+}
+
+func TestDaemonCycleConflict(t *testing.T) {
+	env := newTestEnv(t)
+	env.setup()
+	zshrc := env.writeHome(".zshrc", "export EDITOR=vim\n")
+	env.mustRun("track", zshrc)
+	env.mustRun("push")
+
+	env.pushFromOther(zshrc, "export EDITOR=emacs\n")
+	env.writeHome(".zshrc", "export EDITOR=nano\n")
+
+	notifier := &recordingNotifier{}
+	for run := 1; run <= 2; run++ {
+		state, err := daemonCycle(t, env, notifier)
+		if exitCode(err) != ExitConflict || state.Result != DaemonConflict {
+			t.Fatalf("run %d: Result = %s, err = %v, want a conflict", run, state.Result, err)
+		}
+	}
+	// Reported once, not on every run
+	if len(notifier.sent) != 1 || notifier.sent[0] != conflictTitle {
+		t.Errorf("sent %v, want one %q", notifier.sent, conflictTitle)
+	}
+}
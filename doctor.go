@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Doctor check results, from best to worst
+const (
+	DoctorOK   = "ok"
+	DoctorWarn = "warn" // Works, but something is off
+	DoctorFail = "fail" // Commands will fail until it's fixed
+)
+
+// DoctorCheck is the result of one health check, with a fix for anything not ok
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// Symbol returns the glyph shown in front of the check
+func (d DoctorCheck) Symbol() string {
+	switch d.Status {
+	case DoctorOK:
+		return "✓"
+	case DoctorWarn:
+		return "!"
+	default:
+		return "✗"
+	}
+}
+
+// doctor collects check results, later checks use what earlier ones found
+type doctor struct {
+	folder ShorthandPath
+	checks []DoctorCheck
+}
+
+func (d *doctor) ok(name, detail string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: DoctorOK, Detail: detail})
+}
+
+func (d *doctor) warn(name, detail, fix string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: DoctorWarn, Detail: detail, Fix: fix})
+}
+
+func (d *doctor) fail(name, detail, fix string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: DoctorFail, Detail: detail, Fix: fix})
+}
+
+// RunDoctor checks the whole installation, from git itself to the tracked files
+// Checks that depend on a failed one are skipped, their failure would only repeat it
+func RunDoctor(ctx context.Context, folder ShorthandPath) []DoctorCheck {
+	d := &doctor{folder: folder}
+
+	gitOK := d.checkGit(ctx)
+	if !d.checkFolder() {
+		return d.checks
+	}
+	if gitOK && d.checkRepository() {
+		git := NewGitRunner()
+		d.checkRemotes(ctx, git)
+		d.checkUpstream(ctx, git)
+		d.checkConflicts()
+	}
+	if config, ok := d.checkConfig(); ok {
+		d.checkOrphans(config)
+		d.checkTrackedPaths(config)
+	}
+	return d.checks
+}
+
+// DoctorFailed reports whether any check failed
+func DoctorFailed(checks []DoctorCheck) bool {
+	return slices.ContainsFunc(checks, func(c DoctorCheck) bool { return c.Status == DoctorFail })
+}
+
+func (d *doctor) checkGit(ctx context.Context) bool {
+	if _, err := exec.LookPath("git"); err != nil {
+		d.fail("git", "git is not installed or not in PATH", "Install git from https://git-scm.com or your package manager")
+		return false
+	}
+	version, err := gitCommand(ctx, "", "--version").Output()
+	if err != nil {
+		d.fail("git", fmt.Sprintf("git --version failed: %v", err), "Reinstall git")
+		return false
+	}
+	d.ok("git", strings.TrimSpace(string(version)))
+	return true
+}
+
+func (d *doctor) checkFolder() bool {
+	info, err := os.Stat(d.folder.FullPath)
+	if err != nil {
+		d.fail("config folder", d.folder.TildePath+" does not exist",
+			"Run 'config-sync init' to start fresh, or 'config-sync init-from <url>' to clone your repository")
+		return false
+	}
+	if !info.IsDir() {
+		d.fail("config folder", d.folder.TildePath+" is not a directory", "Move "+d.folder.TildePath+" out of the way and run 'config-sync init'")
+		return false
+	}
+
+	probe, err := os.CreateTemp(d.folder.FullPath, ".doctor-")
+	if err != nil {
+		d.fail("config folder", d.folder.TildePath+" is not writable", "chmod u+rwx "+d.folder.TildePath)
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	d.ok("config folder", d.folder.TildePath)
+	return true
+}
+
+func (d *doctor) checkRepository() bool {
+	if _, err := os.Stat(d.folder.Suffix(".git").FullPath); err != nil {
+		d.fail("repository", d.folder.TildePath+" is not a git repository", "Run 'config-sync init' to create it")
+		return false
+	}
+	d.ok("repository", d.folder.Suffix(".git").TildePath)
+	return true
+}
+
+func (d *doctor) checkRemotes(ctx context.Context, git GitRunner) {
+	remotes, err := git.Remotes(ctx)
+	if err != nil {
+		d.fail("remotes", err.Error(), "Check "+d.folder.Suffix(".git/config").TildePath)
+		return
+	}
+	if !slices.ContainsFunc(remotes, func(r Remote) bool { return r.Name == primaryRemote }) {
+		d.warn(primaryRemote, "no origin remote, nothing is pushed or pulled", "Run 'config-sync set-origin-repo <url>'")
+	}
+
+	for _, remote := range remotes {
+		if _, err := git.RemoteHead(ctx, remote.Name); err != nil {
+			fix := fmt.Sprintf("Check the network and your credentials with: git -C %s ls-remote %s", d.folder.TildePath, remote.Name)
+			if remote.Name == primaryRemote {
+				d.fail(remote.Name, fmt.Sprintf("%s is unreachable (%v)", remote.URL, err), fix)
+			} else {
+				d.warn(remote.Name, fmt.Sprintf("mirror %s is unreachable (%v)", remote.URL, err), fix)
+			}
+			continue
+		}
+		d.ok(remote.Name, remote.URL+" is reachable")
+	}
+}
+
+func (d *doctor) checkUpstream(ctx context.Context, git GitRunner) {
+	upstream, err := git.Upstream(ctx)
+	if err != nil {
+		d.warn("upstream", "main doesn't track a remote branch yet, so unpushed commits can't be detected",
+			"Run 'config-sync push' once")
+		return
+	}
+	d.ok("upstream", "main tracks "+upstream)
+}
+
+func (d *doctor) checkConflicts() {
+	if !isMergeConflict(d.folder.FullPath) {
+		d.ok("merge state", "no unresolved merge")
+		return
+	}
+	d.fail("merge state", "a merge is unfinished or has unmerged files",
+		fmt.Sprintf("Edit the conflicted files in %s, then git add and git commit, or 'git merge --abort' to give up on the pull", d.folder.TildePath))
+}
+
+// checkConfig parses config.json and checks its content beyond what json.Unmarshal accepts
+func (d *doctor) checkConfig() (*JsonConfig, bool) {
+	path := d.folder.Suffix("config.json")
+	content, err := os.ReadFile(path.FullPath)
+	if err != nil {
+		d.fail("config.json", err.Error(), "Run 'config-sync init', or restore it with: git -C "+d.folder.TildePath+" checkout config.json")
+		return nil, false
+	}
+
+	if err := json.Unmarshal(content, &JsonConfig{}); err != nil {
+		d.fail("config.json", "invalid JSON: "+err.Error(), "Fix it by hand, or restore it with: git -C "+d.folder.TildePath+" checkout config.json")
+		return nil, false
+	}
+	var config JsonConfig
+	if err := config.Initialize(d.folder); err != nil {
+		d.fail("config.json", err.Error(), "Check the permissions of "+path.TildePath)
+		return nil, false
+	}
+	if config.Files == nil {
+		d.fail("config.json", `"files" is missing`, `Add "files": {} to `+path.TildePath)
+		return nil, false
+	}
+
+	var problems []string
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&JsonConfig{}); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for tildePath, name := range config.Files {
+		if !strings.HasPrefix(tildePath, "~/") && !filepath.IsAbs(tildePath) {
+			problems = append(problems, fmt.Sprintf("%q is neither under ~/ nor absolute", tildePath))
+		} else if name != filepath.Base(tildePath) {
+			problems = append(problems, fmt.Sprintf("%q should map to %q, not %q", tildePath, filepath.Base(tildePath), name))
+		}
+	}
+	if _, err := ResolveTimeouts(&config); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if name := cmp.Or(checkerAliases[config.Check], config.Check); name != "" && checkers[name] == nil {
+		problems = append(problems, fmt.Sprintf("unknown check strategy %q (available: %s)", config.Check, strings.Join(CheckerNames(), ", ")))
+	}
+	// Also loads local.json, so a broken one shows up here
+	if _, err := config.SigningSettings(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		d.warn("config.json", strings.Join(problems, "; "), "Edit "+path.TildePath+", or untrack and track the path again")
+		return &config, true
+	}
+	d.ok("config.json", fmt.Sprintf("%d tracked paths", len(config.Files)))
+	return &config, true
+}
+
+func (d *doctor) checkOrphans(config *JsonConfig) {
+	orphans, err := orphanedEntries(config)
+	if err != nil {
+		d.fail("synced-files", err.Error(), "chmod u+rwx "+d.folder.Suffix("synced-files").TildePath)
+		return
+	}
+	if len(orphans) > 0 {
+		d.warn("synced-files", "entries of no tracked path: "+strings.Join(orphans, ", "),
+			"Run 'config-sync gc' to see where they came from and 'config-sync gc --remove' to delete them")
+		return
+	}
+	d.ok("synced-files", "every entry belongs to a tracked path")
+}
+
+func (d *doctor) checkTrackedPaths(config *JsonConfig) {
+	var missing, unreadable []string
+	for _, tildePath := range config.trackedPaths() {
+		path := ShorthandPath{}.New(tildePath)
+		if _, err := statWithTimeout(path.FullPath, appTimeouts.FileStat); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, tildePath)
+			} else {
+				unreadable = append(unreadable, fmt.Sprintf("%s (%v)", tildePath, err))
+			}
+			continue
+		}
+		if err := checkReadable(path.FullPath); err != nil {
+			unreadable = append(unreadable, fmt.Sprintf("%s (%v)", tildePath, err))
+		}
+	}
+
+	if len(missing) > 0 {
+		d.warn("tracked paths", "missing: "+strings.Join(missing, ", "),
+			"Run 'config-sync pull' to restore them, or 'config-sync untrack <path>' to stop syncing them")
+	}
+	if len(unreadable) > 0 {
+		d.fail("permissions", "can't read "+strings.Join(unreadable, ", "), "chmod u+r the files, or untrack them")
+	}
+	if len(missing) == 0 && len(unreadable) == 0 {
+		d.ok("tracked paths", "all exist and are readable")
+	}
+}
+
+// checkReadable opens a file, or every file and directory below a directory
+// The first error is returned, that's enough to point at the problem
+func checkReadable(path string) error {
+	return filepath.WalkDir(path, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Exit codes of failed commands, 0 and 2-4 are the sync states of check-updates and status
+const (
+	ExitError          = 1   // Any failure without a more specific code
+	ExitUsage          = 5   // Invalid arguments or flags
+	ExitNotInitialized = 6   // The config folder doesn't exist or has no config.json
+	ExitConflict       = 7   // A merge conflict has to be resolved by hand
+	ExitNetwork        = 8   // The remote is unreachable, worth retrying later
+	ExitBusy           = 9   // Another config-sync run holds the repository lock
+	ExitSecret         = 10  // A path looks like it holds credentials
+	ExitInterrupted    = 130 // Ctrl-C or SIGTERM, like shells report a SIGINT
+)
+
+// exitCodesHelp documents the exit codes for the root command's help
+const exitCodesHelp = "Exit codes:\n" +
+	"  0    success\n" +
+	"  1    error\n" +
+	"  2-4  needs push, needs pull, diverged (check-updates and status with --output)\n" +
+	"  5    invalid arguments or flags\n" +
+	"  6    not initialized\n" +
+	"  7    merge conflict\n" +
+	"  8    remote unreachable\n" +
+	"  9    repository busy\n" +
+	"  10   secret detected\n" +
+	"  130  interrupted"
+
+// errNotInitialized is returned when there is no config to work with
+var errNotInitialized = errors.New("config not initialized")
+
+// usageError marks invalid arguments or flags
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+// usageErrorf formats a usageError
+func usageErrorf(format string, args ...any) error {
+	return &usageError{fmt.Errorf(format, args...)}
+}
+
+// secretError marks a path refused because it looks like it holds credentials
+type secretError struct {
+	path string
+}
+
+func (e *secretError) Error() string {
+	return fmt.Sprintf("%s looks like it holds credentials, pass --allow-secrets to track it anyway", e.path)
+}
+
+// silentExit ends a command with an exit code without reporting an error,
+// for commands whose output already says what went wrong
+type silentExit int
+
+func (e silentExit) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+// exitCode maps an error returned by a command to its documented exit code
+func exitCode(err error) int {
+	var silent silentExit
+	var usage *usageError
+	var conflict *conflictError
+	var netErr *networkError
+	var secret *secretError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &silent):
+		return int(silent)
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.Is(err, errNotInitialized):
+		return ExitNotInitialized
+	case errors.As(err, &conflict):
+		return ExitConflict
+	case errors.As(err, &netErr):
+		return ExitNetwork
+	case errors.Is(err, errRepoBusy):
+		return ExitBusy
+	case errors.As(err, &secret):
+		return ExitSecret
+	}
+	return ExitError
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"plain error", errors.New("boom"), ExitError},
+		{"silent exit", silentExit(3), 3},
+		{"wrapped silent exit", fmt.Errorf("status: %w", silentExit(ExitNetwork)), ExitNetwork},
+		{"interrupted", context.Canceled, ExitInterrupted},
+		{"wrapped interrupt", fmt.Errorf("push failed: %w", context.Canceled), ExitInterrupted},
+		{"deadline is not an interrupt", context.DeadlineExceeded, ExitError},
+		{"usage", usageErrorf("--ago must not be negative"), ExitUsage},
+		{"not initialized", fmt.Errorf("loading config: %w", errNotInitialized), ExitNotInitialized},
+		{"conflict", &conflictError{errors.New("merge conflict")}, ExitConflict},
+		{"wrapped conflict", fmt.Errorf("pull failed: %w", &conflictError{errors.New("merge conflict")}), ExitConflict},
+		{"network", &networkError{errors.New("unreachable")}, ExitNetwork},
+		{"busy", fmt.Errorf("%w (waited 10s)", errRepoBusy), ExitBusy},
+		{"secret", &secretError{"~/.ssh/id_rsa"}, ExitSecret},
+		{"joined picks the first match", errors.Join(errors.New("boom"), &networkError{errors.New("unreachable")}), ExitNetwork},
+		{"interrupt wins over the cause", &networkError{context.Canceled}, ExitInterrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandExitCodes(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.setup()
+		env.mustRun("track", env.writeHome(".zshrc", "export EDITOR=vim\n"))
+		if code, _, logs := env.run("push"); code != 0 {
+			t.Errorf("push exited %d, want 0:\n%s", code, logs)
+		}
+	})
+
+	t.Run("not initialized", func(t *testing.T) {
+		env := newTestEnv(t)
+		if code, _, logs := env.run("push"); code != ExitNotInitialized {
+			t.Errorf("push exited %d, want %d:\n%s", code, ExitNotInitialized, logs)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.setup()
+		for _, args := range [][]string{
+			{"push", "--no-such-flag"},
+			{"restore", "~/.zshrc"},
+			{"restore", "~/.zshrc", "--at", "HEAD", "--ago", "1"},
+		} {
+			if code, _, logs := env.run(args...); code != ExitUsage {
+				t.Errorf("%v exited %d, want %d:\n%s", args, code, ExitUsage, logs)
+			}
+		}
+	})
+
+	t.Run("named paths are not checked for secrets", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.setup()
+		tokens := env.writeHome(".config/tool/tokens.yml", "theme: dark\n")
+		if code, _, logs := env.run("track", tokens); code != 0 {
+			t.Errorf("track %s exited %d, want 0:\n%s", tokens, code, logs)
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.setup()
+		lock, err := AcquireRepoLock(ShorthandPath{}.New(env.folder), true, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lock.Release()
+		if code, _, logs := env.run("push", "--timeout", "lock_wait=100ms"); code != ExitBusy {
+			t.Errorf("push exited %d, want %d:\n%s", code, ExitBusy, logs)
+		}
+	})
+
+	t.Run("network", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.setup()
+		env.mustRun("track", env.writeHome(".zshrc", "export EDITOR=vim\n"))
+		if err := os.RemoveAll(env.origin); err != nil {
+			t.Fatal(err)
+		}
+		if code, _, logs := env.run("push"); code != ExitNetwork {
+			t.Errorf("push exited %d, want %d:\n%s", code, ExitNetwork, logs)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.setup()
+		zshrc := env.writeHome(".zshrc", "export EDITOR=vim\n")
+		env.mustRun("track", zshrc)
+		env.mustRun("push")
+
+		// Another machine changes the same line
+		env.pushFromOther(zshrc, "export EDITOR=emacs\n")
+
+		env.writeHome(".zshrc", "export EDITOR=nano\n")
+		if code, _, logs := env.run("push"); code != ExitError {
+			t.Errorf("push behind the remote exited %d, want %d:\n%s", code, ExitError, logs)
+		}
+		if code, _, logs := env.run("pull"); code != ExitConflict {
+			t.Errorf("pull exited %d, want %d:\n%s", code, ExitConflict, logs)
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultPruneMinSize is the smallest removed file --prune-history offers to drop
+const defaultPruneMinSize = 1 << 20
+
+// OrphanedEntry is a synced-files entry that belongs to no tracked path
+type OrphanedEntry struct {
+	Hash      string   `json:"hash"`
+	TildePath string   `json:"path,omitempty"` // The path it was synced from, found in older config.json versions, empty if unknown
+	Names     []string `json:"names"`          // What's inside, to tell unknown entries apart
+	Size      int64    `json:"size"`
+}
+
+// Label names the entry by its original path, or by its content when the path is unknown
+func (o OrphanedEntry) Label() string {
+	if o.TildePath != "" {
+		return o.TildePath
+	}
+	return "unknown (" + strings.Join(o.Names, ", ") + ")"
+}
+
+// orphanedEntries lists the synced-files entries that belong to no tracked path
+func orphanedEntries(config *JsonConfig) ([]string, error) {
+	entries, err := os.ReadDir(config.folder.Suffix("synced-files").FullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for tildePath := range config.Files {
+		known[md5Hash(tildePath)] = true
+	}
+	var orphans []string
+	for _, entry := range entries {
+		if !known[entry.Name()] {
+			orphans = append(orphans, entry.Name())
+		}
+	}
+	return orphans, nil
+}
+
+// FindOrphans lists the orphaned synced-files entries with their size, content and original path
+func FindOrphans(ctx context.Context, git GitRunner, config *JsonConfig) ([]OrphanedEntry, error) {
+	hashes, err := orphanedEntries(config)
+	if err != nil || len(hashes) == 0 {
+		return nil, err
+	}
+
+	formerPaths := trackedPathHistory(ctx, git)
+	orphans := make([]OrphanedEntry, 0, len(hashes))
+	for _, hash := range hashes {
+		dir := config.folder.Suffix(filepath.Join("synced-files", hash)).FullPath
+		orphan := OrphanedEntry{Hash: hash, TildePath: formerPaths[hash]}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			orphan.Names = append(orphan.Names, entry.Name())
+		}
+		if orphan.Size, err = dirSize(dir); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, orphan)
+	}
+	return orphans, nil
+}
+
+// trackedPathHistory maps the md5 of every path ever tracked to the path, from all config.json versions
+// History that can't be read just leaves entries unidentified
+func trackedPathHistory(ctx context.Context, git GitRunner) map[string]string {
+	paths := make(map[string]string)
+	commits, _ := git.PathCommits(ctx, "config.json")
+	for _, commit := range commits {
+		content, err := git.ReadFileAt(ctx, commit, "config.json")
+		if err != nil {
+			continue
+		}
+		var config JsonConfig
+		if json.Unmarshal(content, &config) != nil {
+			continue
+		}
+		for tildePath := range config.Files {
+			paths[md5Hash(tildePath)] = tildePath
+		}
+	}
+	return paths
+}
+
+// dirSize adds up the size of every file below dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// RemoveOrphans deletes the orphaned entries and commits their removal
+// Nothing else is synced or committed, and nothing is pushed
+func RemoveOrphans(ctx context.Context, git GitRunner, config *JsonConfig, orphans []OrphanedEntry) error {
+	paths := make([]string, 0, len(orphans))
+	for _, orphan := range orphans {
+		relative := "synced-files/" + orphan.Hash
+		if err := os.RemoveAll(config.folder.Suffix(relative).FullPath); err != nil {
+			return err
+		}
+		log.Printf("Removed %s (%s)\n", relative, orphan.Label())
+		paths = append(paths, relative)
+	}
+
+	if err := git.AddPaths(ctx, paths...); err != nil {
+		return fmt.Errorf("git add failed: %w", err)
+	}
+	summary, err := config.SummarizeStagedChanges(ctx, git)
+	if err != nil {
+		return fmt.Errorf("reading staged changes failed: %w", err)
+	}
+	// Entries that were never committed leave nothing to commit
+	if summary.IsEmpty() {
+		return nil
+	}
+	subject := fmt.Sprintf("Remove %d orphaned synced-files %s", len(orphans), plural(len(orphans), "entry", "entries"))
+	if err := git.Commit(ctx, BuildCommitMessage(summary, subject)); err != nil {
+		return fmt.Errorf("git commit failed: %w", err)
+	}
+	return nil
+}
+
+// RemovedFile is a file that is only left in the history, with all its versions
+type RemovedFile struct {
+	Path      string // Repository path, synced-files/<md5>/...
+	TildePath string // The tracked path it belonged to, empty if unknown
+	Versions  int
+	Size      int64 // Total size of all versions
+}
+
+// FindRemovedFiles lists the files no longer in synced-files whose versions add up to at least minSize
+// Largest first, those are the ones worth rewriting history for
+func FindRemovedFiles(ctx context.Context, git GitRunner, minSize int64) ([]RemovedFile, error) {
+	blobs, err := git.RemovedBlobs(ctx, "synced-files/")
+	if err != nil {
+		return nil, err
+	}
+
+	formerPaths := trackedPathHistory(ctx, git)
+	byPath := make(map[string]*RemovedFile)
+	for _, blob := range blobs {
+		file, ok := byPath[blob.Path]
+		if !ok {
+			hash, _, _ := strings.Cut(strings.TrimPrefix(blob.Path, "synced-files/"), "/")
+			file = &RemovedFile{Path: blob.Path, TildePath: formerPaths[hash]}
+			byPath[blob.Path] = file
+		}
+		file.Versions++
+		file.Size += blob.Size
+	}
+
+	var files []RemovedFile
+	for _, file := range byPath {
+		if file.Size >= minSize {
+			files = append(files, *file)
+		}
+	}
+	slices.SortFunc(files, func(a, b RemovedFile) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), strings.Compare(a.Path, b.Path))
+	})
+	return files, nil
+}
+
+// Label names the file by the tracked path it belonged to when known
+func (f RemovedFile) Label() string {
+	if f.TildePath == "" {
+		return f.Path
+	}
+	// Files inside a tracked directory keep their place below it
+	_, rest, _ := strings.Cut(strings.TrimPrefix(f.Path, "synced-files/"), "/")
+	if inside, found := strings.CutPrefix(rest, path.Base(f.TildePath)+"/"); found {
+		return path.Join(f.TildePath, inside)
+	}
+	return f.TildePath
+}
+
+// PruneHistory drops the given files from the history of main and force pushes the result
+// The old history is saved as a bundle in .backups first
+func PruneHistory(ctx context.Context, git GitRunner, folder ShorthandPath, files []RemovedFile) error {
+	// Checked before anything is rewritten, a force push that can only fail afterwards strands the rewrite
+	leases, err := pushLeases(ctx, git)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	if err := ensureLocalIgnores(folder); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	bundle := folder.Suffix(filepath.Join(".backups", "history-"+stamp+".bundle"))
+	if err := git.RewriteHistory(ctx, paths, bundle.FullPath); err != nil {
+		return err
+	}
+	log.Printf("Old history saved to %s\n", bundle.TildePath)
+
+	if err := git.ForcePush(ctx, leases); err != nil {
+		return fmt.Errorf("the local history is already rewritten: %w", err)
+	}
+	if head, err := git.ResolveRevision(ctx, "HEAD"); err == nil {
+		RecordRemoteHead(folder, head)
+	}
+	return git.Compact(ctx)
+}
+
+// pushLeases returns main of every push-enabled remote, to force push only where it hasn't moved since
+// A remote that's unreachable or has commits missing here would end up out of sync, so that's an error
+func pushLeases(ctx context.Context, git GitRunner) (map[string]string, error) {
+	remotes, err := git.Remotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	leases := make(map[string]string)
+	for _, remote := range remotes {
+		if !remote.Push {
+			continue
+		}
+		head, err := git.RemoteHead(ctx, remote.Name)
+		if err != nil {
+			return nil, &networkError{fmt.Errorf("%w, history is only rewritten when every push remote can be updated", err)}
+		}
+		if head != "" && !git.InHistory(ctx, head) {
+			return nil, fmt.Errorf("%s has commits that aren't here yet, run 'config-sync pull' first", remote.Name)
+		}
+		leases[remote.Name] = head
+	}
+	return leases, nil
+}
+
+// confirm asks a question on stdout and reads the answer from in
+// Only the exact answer counts, anything else (including no input at all) is a no
+func confirm(in io.Reader, question, answer string) bool {
+	fmt.Printf("%s Type '%s' to continue: ", question, answer)
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(line) == answer
+}
+
+// formatSize formats a byte count for humans
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// plural picks the singular or plural form for n
+func plural(n int, singular, pluralForm string) string {
+	if n == 1 {
+		return singular
+	}
+	return pluralForm
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// orphanEnv pushes a synced-files entry that belongs to no tracked path
+func orphanEnv(t *testing.T) *testEnv {
+	t.Helper()
+	env := newTestEnv(t)
+	env.setup()
+	env.mustRun("track", env.writeHome(".zshrc", "export EDITOR=vim\n"))
+	env.mustRun("push")
+
+	orphan := filepath.Join(env.folder, "synced-files", md5Hash("~/.old-tool"), ".old-tool")
+	os.MkdirAll(filepath.Dir(orphan), 0755)
+	os.WriteFile(orphan, []byte(strings.Repeat("x", 4096)), 0644)
+	env.git(env.folder, "add", "synced-files")
+	env.git(env.folder, "commit", "--quiet", "-m", "Left behind")
+	env.git(env.folder, "push", "--quiet", "origin", "main")
+	return env
+}
+
+func TestPruneHistoryAfterRemove(t *testing.T) {
+	env := orphanEnv(t)
+
+	// The removal commit isn't pushed yet when the history is rewritten
+	env.mustRun("gc", "--remove", "--prune-history", "--min-size", "1", "--yes")
+	local := env.git(env.folder, "rev-parse", "HEAD")
+	if remote := env.git(env.origin, "rev-parse", "main"); remote != local {
+		t.Errorf("origin is at %s after pruning, local at %s", remote, local)
+	}
+	if found := env.git(env.folder, "log", "--all", "--format=%H", "--", "synced-files/"+md5Hash("~/.old-tool")); found != "" {
+		t.Errorf("the removed file is still in commits %s", found)
+	}
+}
+
+func TestPruneHistoryRefusesWhenBehind(t *testing.T) {
+	env := orphanEnv(t)
+	other := env.clone()
+	os.WriteFile(filepath.Join(other, "notes"), []byte("from another machine\n"), 0644)
+	env.git(other, "add", "notes")
+	env.git(other, "commit", "--quiet", "-m", "Another machine")
+	env.git(other, "push", "--quiet", "origin", "HEAD")
+
+	before := env.git(env.folder, "rev-parse", "HEAD")
+	code, _, logs := env.run("gc", "--remove", "--prune-history", "--min-size", "1", "--yes")
+	if code != ExitError || !strings.Contains(logs, "config-sync pull") {
+		t.Errorf("gc exited %d, want %d with a hint to pull:\n%s", code, ExitError, logs)
+	}
+	// Only the removal commit, nothing rewritten
+	if parent := env.git(env.folder, "rev-parse", "HEAD~1"); parent != before {
+		t.Errorf("local history was rewritten: HEAD~1 is %s, was HEAD %s", parent, before)
+	}
+}
@@ -1,105 +1,224 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// isMergeConflict checks if there are merge conflict markers in the directory
+// isMergeConflict checks whether the repository in dir is in the middle of a merge or has unmerged paths
+// File content isn't looked at, tracked files may well contain lines like =======
 func isMergeConflict(dir string) bool {
-	// Check for common conflict markers in files
-	conflictMarkers := []string{"<<<<<<<", ">>>>>>>", "======="}
-
-	for _, marker := range conflictMarkers {
-		// Use git grep to find conflict markers
-		cmd := exec.Command("git", "grep", "-q", marker, "--", ".")
-		cmd.Dir = dir
-		// Don't output anything
-		if cmd.Run() == nil {
-			return true
-		}
+	if _, err := os.Stat(filepath.Join(dir, ".git", "MERGE_HEAD")); err == nil {
+		return true
 	}
 
-	// Also check for unmerged files in git status
-	cmd := exec.Command("git", "status", "--porcelain")
+	cmd := exec.Command("git", "ls-files", "--unmerged")
 	cmd.Dir = dir
 	output, err := cmd.Output()
-	if err != nil {
-		return false
-	}
-
-	// Look for UU (both modified) or other conflict indicators
-	status := string(output)
-	return strings.Contains(status, "UU") || strings.Contains(status, "AA") || strings.Contains(status, "DD")
+	return err == nil && len(bytes.TrimSpace(output)) > 0
 }
 
 // GitRunner defines git operations
 type GitRunner interface {
-	Pull() error
-	Push() error
-	SetOrigin(url string, force bool) error
-	Add() error
-	Commit(message string) error
-	AddAndPush(message string) error
-	Init() error
-	Clone(url string) error
-	HasUnpushedChanges() (bool, error)
-	HasUnpulledChanges() (bool, error)
+	Pull(ctx context.Context) error
+	Push(ctx context.Context) error
+	SetOrigin(ctx context.Context, url string, replace, force bool) error
+	Add(ctx context.Context) error
+	Commit(ctx context.Context, message string) error
+	AddAndPush(ctx context.Context, message string) error
+	Init(ctx context.Context) error
+	Clone(ctx context.Context, url string) error
+	HasUnpushedChanges(ctx context.Context) (bool, error)
+	HasUnpulledChanges(ctx context.Context) (bool, error)
+	ResolveRevision(ctx context.Context, at string) (string, error)
+	ExportPath(ctx context.Context, commit, path, destDir string) error
+	ReadFileAt(ctx context.Context, commit, path string) ([]byte, error)
+	StagedChanges(ctx context.Context) (map[string]string, error)
+	Fetch(ctx context.Context) error
+	Merge(ctx context.Context, rev string) error
+	VerifyCommits(ctx context.Context, revRange string, trustedKeys []string) ([]string, error)
+	Remotes(ctx context.Context) ([]Remote, error)
+	AddRemote(ctx context.Context, name, url string, push bool) error
+	RemoveRemote(ctx context.Context, name string) error
+	SetRemoteURL(ctx context.Context, name, url string) error
+	SetRemotePush(ctx context.Context, name string, push bool) error
+	RemoteHead(ctx context.Context, name string) (string, error)
+	Upstream(ctx context.Context) (string, error)
+	AddPaths(ctx context.Context, paths ...string) error
+	PathCommits(ctx context.Context, path string) ([]string, error)
+	PathVersions(ctx context.Context, path string) ([]string, error)
+	RemovedBlobs(ctx context.Context, prefix string) ([]HistoryBlob, error)
+	RewriteHistory(ctx context.Context, paths []string, bundle string) error
+	ForcePush(ctx context.Context, leases map[string]string) error
+	InHistory(ctx context.Context, commit string) bool
+	Compact(ctx context.Context) error
+	PathLog(ctx context.Context, path string) ([]LogEntry, error)
+	Signing() SigningConfig
 }
 
 // RealGitRunner executes actual git commands
 type RealGitRunner struct {
-	dir string
+	dir     string
+	signing SigningConfig
 }
 
-func (g RealGitRunner) run(args ...string) error {
-	cmd := exec.Command("git", args...)
-	cmd.Dir = g.dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// gitInterruptGrace is how long git gets to clean up after an interrupt before it's killed
+const gitInterruptGrace = 5 * time.Second
+
+// gitCommand creates a git command that is interrupted when ctx is done
+// git removes its lock files on SIGINT, a plain kill could leave index.lock behind
+func gitCommand(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = gitInterruptGrace
+	return cmd
 }
 
-func (g RealGitRunner) Pull() error {
-	log.Printf("Pulling from %s\n", configFolder().TildePath)
-	err := g.run("pull", "--no-rebase", "origin", "main")
-	if err != nil && isMergeConflict(g.dir) {
-		return fmt.Errorf("merge conflict detected in %s\n\n"+
-			"Please resolve the conflicts manually:\n"+
-			"  1. cd %s\n"+
-			"  2. Edit conflicted files and remove conflict markers\n"+
-			"  3. git add <resolved files>\n"+
-			"  4. git commit\n"+
-			"  5. Run 'config-sync pull' again to restore files",
-			configFolder().TildePath, configFolder().TildePath)
+func (g RealGitRunner) run(ctx context.Context, args ...string) error {
+	return runLogged(gitCommand(ctx, g.dir, args...))
+}
+
+// runLogged runs a git command and keeps its output out of the way
+// With --verbose the command and its output are logged as they happen, otherwise the
+// output is only logged when the command fails
+func runLogged(cmd *exec.Cmd) error {
+	var output bytes.Buffer
+	stream := &lineLogger{prefix: "  "}
+	if logVerbose {
+		debugf("%s", strings.Join(cmd.Args, " "))
+		cmd.Stdout = io.MultiWriter(&output, stream)
+	} else {
+		cmd.Stdout = &output
+	}
+	cmd.Stderr = cmd.Stdout
+
+	err := cmd.Run()
+	stream.Flush()
+	if err != nil && !logVerbose {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			logAt(levelWarn, "%s failed:\n%s", strings.Join(cmd.Args, " "), out)
+		}
 	}
 	return err
 }
 
-func (g RealGitRunner) Push() error {
-	log.Printf("Pushing to %s\n", configFolder().TildePath)
-	err := g.run("push", "-u", "origin", "main")
+func (g RealGitRunner) Pull(ctx context.Context) error {
+	err := g.withFallback(ctx, func(remote string) error {
+		log.Printf("Pulling from %s into %s\n", remote, configFolder().TildePath)
+		args := append(g.signing.gitArgs(), "pull", "--no-rebase")
+		if g.signing.Enabled() {
+			args = append(args, "-S")
+		}
+		return g.run(ctx, append(args, remote, "main")...)
+	})
+	// Only a pull that reached its remote got as far as merging
+	var netErr *networkError
+	if err != nil && !errors.As(err, &netErr) && ctx.Err() == nil && isMergeConflict(g.dir) {
+		return pullConflictError()
+	}
+	return err
+}
+
+// Fetch downloads the remote main branch into FETCH_HEAD without merging it
+// Falls back to a mirror when the primary remote is unreachable
+func (g RealGitRunner) Fetch(ctx context.Context) error {
+	return g.withFallback(ctx, func(remote string) error {
+		log.Printf("Fetching from %s into %s\n", remote, configFolder().TildePath)
+		return g.run(ctx, "fetch", remote, "main")
+	})
+}
+
+// Merge merges a fetched revision into the current branch
+func (g RealGitRunner) Merge(ctx context.Context, rev string) error {
+	args := append(g.signing.gitArgs(), "merge", "--no-edit")
+	if g.signing.Enabled() {
+		args = append(args, "-S")
+	}
+	err := g.run(ctx, append(args, rev)...)
 	if err != nil && isMergeConflict(g.dir) {
-		return fmt.Errorf("merge conflict detected in %s\n\n"+
-			"Please resolve the conflicts manually:\n"+
-			"  1. cd %s\n"+
-			"  2. Edit conflicted files and remove conflict markers\n"+
-			"  3. git add <resolved files>\n"+
-			"  4. git commit\n"+
-			"  5. Run 'config-sync push' again",
-			configFolder().TildePath, configFolder().TildePath)
+		return pullConflictError()
 	}
 	return err
 }
 
-func (g RealGitRunner) SetOrigin(url string, force bool) error {
+// pullConflictError explains how to recover from a conflicting pull
+func pullConflictError() error {
+	return &conflictError{fmt.Errorf("merge conflict detected in %s\n\n"+
+		"Please resolve the conflicts manually:\n"+
+		"  1. cd %s\n"+
+		"  2. Edit conflicted files and remove conflict markers\n"+
+		"  3. git add <resolved files>\n"+
+		"  4. git commit\n"+
+		"  5. Run 'config-sync pull' again to restore files",
+		configFolder().TildePath, configFolder().TildePath)}
+}
+
+// Push pushes main to every push-enabled remote
+// The primary remote is pushed first and set as upstream, mirrors are only pushed once it has the commits
+func (g RealGitRunner) Push(ctx context.Context) error {
+	remotes, err := g.Remotes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	pushed := 0
+	unreachable := true // Whether every failed remote is unreachable
+	for _, remote := range remotes {
+		if !remote.Push {
+			continue
+		}
+		pushed++
+
+		log.Printf("Pushing %s to %s\n", configFolder().TildePath, remote.Name)
+		args := []string{"push", remote.Name, "main"}
+		if remote.Name == primaryRemote {
+			args = []string{"push", "-u", remote.Name, "main"}
+		}
+		if err := g.run(ctx, args...); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", remote.Name, err))
+			if _, reachErr := g.RemoteHead(ctx, remote.Name); reachErr == nil || ctx.Err() != nil {
+				unreachable = false
+			}
+			// Mirrors must not get ahead of the primary remote
+			if remote.Name == primaryRemote {
+				break
+			}
+		}
+	}
+
+	if pushed == 0 {
+		return fmt.Errorf("no push-enabled remotes. Run 'config-sync set-origin-repo <url>' or 'config-sync remote add <name> <url>'")
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("push failed for %s", strings.Join(failed, ", "))
+		if unreachable {
+			return &networkError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// SetOrigin points the primary remote at url
+// An existing origin is only changed with replace, and the URL has to be reachable and
+// hold a config-sync repository (or be empty) unless force is set
+func (g RealGitRunner) SetOrigin(ctx context.Context, url string, replace, force bool) error {
 	// Check if repo is public (only for SSH URLs that can be converted to HTTPS)
 	if !force {
 		if httpsURL := sshToHTTPS(url); httpsURL != "" {
@@ -111,13 +230,79 @@ func (g RealGitRunner) SetOrigin(url string, force bool) error {
 
 	// Auto-init if needed
 	if _, err := os.Stat(filepath.Join(g.dir, ".git")); err != nil {
-		if err := g.Init(); err != nil {
+		if err := g.Init(ctx); err != nil {
 			return fmt.Errorf("git init failed: %w", err)
 		}
 	}
 
+	current, err := g.output(ctx, "remote", "get-url", primaryRemote)
+	hasOrigin := err == nil
+	if hasOrigin && current == url {
+		log.Printf("Origin is already set to %s\n", url)
+		return nil
+	}
+	if hasOrigin && !replace {
+		return fmt.Errorf("origin is already set to %s.\nUse --replace to point it at %s instead", current, url)
+	}
+
+	if !force {
+		if err := g.validateOrigin(ctx, url); err != nil {
+			return fmt.Errorf("%w.\nUse --force to set this origin anyway", err)
+		}
+	}
+
 	// Set the remote
-	return g.run("remote", "add", "origin", url)
+	if hasOrigin {
+		log.Printf("Replacing origin %s\n", current)
+		return g.SetRemoteURL(ctx, primaryRemote, url)
+	}
+	return g.run(ctx, "remote", "add", primaryRemote, url)
+}
+
+// validateOrigin checks that url is reachable and is either empty or a compatible config-sync repository
+func (g RealGitRunner) validateOrigin(ctx context.Context, url string) error {
+	// Only the reachability probe is limited by git_remote, the fetch below takes as long as a pull would
+	probeCtx, cancel := timeoutContext(ctx, appTimeouts.GitRemote)
+	defer cancel()
+
+	cmd := gitCommand(probeCtx, g.dir, "ls-remote", "--heads", url)
+	heads, err := cmd.Output()
+	if err != nil {
+		if probeCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out reaching %s", url)
+		}
+		return fmt.Errorf("could not reach %s", url)
+	}
+
+	// An empty repository is fine, the first push fills it
+	if strings.TrimSpace(string(heads)) == "" {
+		return nil
+	}
+	if !strings.Contains(string(heads), "\trefs/heads/main") {
+		return fmt.Errorf("%s has no main branch, it doesn't look like a config-sync repository", url)
+	}
+
+	if _, err := g.output(ctx, "fetch", "--quiet", url, "main"); err != nil {
+		return err
+	}
+
+	content, err := g.ReadFileAt(ctx, "FETCH_HEAD", "config.json")
+	if err != nil {
+		return fmt.Errorf("%s has no config.json, it doesn't look like a config-sync repository", url)
+	}
+	var remoteConfig JsonConfig
+	if err := json.Unmarshal(content, &remoteConfig); err != nil || remoteConfig.Files == nil {
+		return fmt.Errorf("config.json in %s is not a config-sync config", url)
+	}
+
+	// Local commits must share history with the remote, otherwise pull can never merge them
+	if _, err := g.output(ctx, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+		if _, err := g.output(ctx, "merge-base", "HEAD", "FETCH_HEAD"); err != nil {
+			return fmt.Errorf("%s has an unrelated history. Use 'config-sync init-from' to start from it", url)
+		}
+	}
+
+	return nil
 }
 
 // sshToHTTPS converts git@github.com:user/repo.git to https://github.com/user/repo
@@ -136,6 +321,15 @@ func sshToHTTPS(url string) string {
 	return ""
 }
 
+// refusePublicRepo returns an error if the repository at url appears to be publicly accessible
+func refusePublicRepo(url string) error {
+	if httpsURL := sshToHTTPS(url); httpsURL != "" && isPublicRepo(httpsURL) {
+		logAt(levelWarn, "⚠️  WARNING: Repository appears to be publicly accessible!")
+		return errors.New("not cloning a public repository. If it contains sensitive configs, use --force only if you understand the risks")
+	}
+	return nil
+}
+
 // isPublicRepo checks if a repo is publicly accessible via HTTP
 func isPublicRepo(httpsURL string) bool {
 	resp, err := http.Head(httpsURL)
@@ -146,31 +340,47 @@ func isPublicRepo(httpsURL string) bool {
 	return resp.StatusCode == 200
 }
 
-func (g RealGitRunner) Add() error {
-	return g.run("add", "-A")
+func (g RealGitRunner) Add(ctx context.Context) error {
+	return g.run(ctx, "add", "-A")
+}
+
+// AddPaths stages the given paths only, including their deletion
+func (g RealGitRunner) AddPaths(ctx context.Context, paths ...string) error {
+	return g.run(ctx, append([]string{"add", "-A", "--"}, paths...)...)
 }
 
-func (g RealGitRunner) Commit(message string) error {
-	return g.run("commit", "-m", message)
+func (g RealGitRunner) Commit(ctx context.Context, message string) error {
+	args := append(g.signing.gitArgs(), "commit", "-m", message)
+	if g.signing.Enabled() {
+		args = append(args, "-S")
+	}
+	return g.run(ctx, args...)
 }
 
-func (g RealGitRunner) AddAndPush(message string) error {
-	if err := g.Add(); err != nil {
+func (g RealGitRunner) AddAndPush(ctx context.Context, message string) error {
+	if err := g.Add(ctx); err != nil {
 		return err
 	}
-	return g.Commit(message)
+	return g.Commit(ctx, message)
 }
 
-func (g RealGitRunner) Init() error {
+func (g RealGitRunner) Init(ctx context.Context) error {
 	// Check if .git exists
 	if _, err := os.Stat(filepath.Join(g.dir, ".git")); err == nil {
 		return nil // Already initialized
 	}
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		return err
+	}
 	log.Printf("Initializing git repository in %s\n", configFolder().TildePath)
-	return g.run("init")
+	if err := g.run(ctx, "init"); err != nil {
+		return err
+	}
+	// Push and pull use main, whatever init.defaultBranch says
+	return g.run(ctx, "symbolic-ref", "HEAD", "refs/heads/main")
 }
 
-func (g RealGitRunner) Clone(url string) error {
+func (g RealGitRunner) Clone(ctx context.Context, url string) error {
 	// Check if directory already has content
 	if _, err := os.Stat(g.dir); err == nil {
 		// Check if it's empty or has .git
@@ -181,10 +391,7 @@ func (g RealGitRunner) Clone(url string) error {
 	}
 
 	log.Printf("Cloning repository into %s\n", configFolder().TildePath)
-	cmd := exec.Command("git", "clone", url, g.dir)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := runLogged(gitCommand(ctx, "", "clone", url, g.dir)); err != nil {
 		return fmt.Errorf("git clone failed: %w", err)
 	}
 
@@ -193,21 +400,19 @@ func (g RealGitRunner) Clone(url string) error {
 }
 
 // HasUnpushedChanges checks if there are local commits not pushed to remote
-func (g RealGitRunner) HasUnpushedChanges() (bool, error) {
+func (g RealGitRunner) HasUnpushedChanges(ctx context.Context) (bool, error) {
 	// Local git operations timeout
-	const timeout = 2 * time.Second
+	timeout := appTimeouts.GitLocal
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	localCtx, cancel := timeoutContext(ctx, timeout)
 	defer cancel()
 
 	// Check for unpushed commits by comparing HEAD to origin/main
-	cmd := exec.CommandContext(ctx, "git", "rev-list", "--left-right", "--count", "HEAD...@{u}")
-	cmd.Dir = g.dir
+	cmd := gitCommand(localCtx, g.dir, "rev-list", "--left-right", "--count", "HEAD...@{u}")
 	output, err := cmd.Output()
-	if err != nil && ctx.Err() == context.DeadlineExceeded {
+	if err != nil && localCtx.Err() == context.DeadlineExceeded {
 		// Timeout, check for uncommitted changes only
-		cmd = exec.Command("git", "status", "--porcelain")
-		cmd.Dir = g.dir
+		cmd = gitCommand(ctx, g.dir, "status", "--porcelain")
 		output, err = cmd.Output()
 		if err != nil {
 			return false, err
@@ -216,8 +421,7 @@ func (g RealGitRunner) HasUnpushedChanges() (bool, error) {
 	}
 	if err != nil {
 		// Upstream branch not set yet, check for uncommitted changes only
-		cmd = exec.Command("git", "status", "--porcelain")
-		cmd.Dir = g.dir
+		cmd = gitCommand(ctx, g.dir, "status", "--porcelain")
 		output, err = cmd.Output()
 		if err != nil {
 			return false, err
@@ -225,16 +429,15 @@ func (g RealGitRunner) HasUnpushedChanges() (bool, error) {
 		return len(strings.TrimSpace(string(output))) > 0, nil
 	}
 
-	// Output format: "behind\tahead" or just counts
+	// Output format: "ahead\tbehind", HEAD is the left side
 	parts := strings.Fields(string(output))
-	if len(parts) >= 2 && parts[1] != "0" {
-		// Second number is commits ahead (unpushed)
+	if len(parts) >= 2 && parts[0] != "0" {
+		// First number is commits ahead (unpushed)
 		return true, nil
 	}
 
 	// Check for uncommitted changes as well
-	cmd = exec.Command("git", "status", "--porcelain")
-	cmd.Dir = g.dir
+	cmd = gitCommand(ctx, g.dir, "status", "--porcelain")
 	output, err = cmd.Output()
 	if err != nil {
 		return false, err
@@ -243,18 +446,22 @@ func (g RealGitRunner) HasUnpushedChanges() (bool, error) {
 	return len(strings.TrimSpace(string(output))) > 0, nil
 }
 
+// Upstream returns the branch the current branch tracks, e.g. origin/main
+func (g RealGitRunner) Upstream(ctx context.Context) (string, error) {
+	return g.output(ctx, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+}
+
 // HasUnpulledChanges checks if there are remote commits not pulled locally
-func (g RealGitRunner) HasUnpulledChanges() (bool, error) {
-	// Git remote operations timeout (5s for ls-remote)
-	const remoteTimeout = 5 * time.Second
-	const localTimeout = 2 * time.Second
+func (g RealGitRunner) HasUnpulledChanges(ctx context.Context) (bool, error) {
+	// Git remote operations timeout (5s for ls-remote by default)
+	remoteTimeout := appTimeouts.GitRemote
+	localTimeout := appTimeouts.GitLocal
 
 	// Get local HEAD
-	ctxLocal, cancelLocal := context.WithTimeout(context.Background(), localTimeout)
+	ctxLocal, cancelLocal := timeoutContext(ctx, localTimeout)
 	defer cancelLocal()
 
-	cmd := exec.CommandContext(ctxLocal, "git", "rev-parse", "HEAD")
-	cmd.Dir = g.dir
+	cmd := gitCommand(ctxLocal, g.dir, "rev-parse", "HEAD")
 	localHead, err := cmd.Output()
 	if err != nil {
 		// No commits yet
@@ -263,11 +470,10 @@ func (g RealGitRunner) HasUnpulledChanges() (bool, error) {
 	localHash := strings.TrimSpace(string(localHead))
 
 	// Get remote HEAD using ls-remote (5s timeout)
-	ctxRemote, cancelRemote := context.WithTimeout(context.Background(), remoteTimeout)
+	ctxRemote, cancelRemote := timeoutContext(ctx, remoteTimeout)
 	defer cancelRemote()
 
-	cmd = exec.CommandContext(ctxRemote, "git", "ls-remote", "--heads", "origin", "main")
-	cmd.Dir = g.dir
+	cmd = gitCommand(ctxRemote, g.dir, "ls-remote", "--heads", "origin", "main")
 	remoteHead, err := cmd.Output()
 	if err != nil {
 		if ctxRemote.Err() == context.DeadlineExceeded {
@@ -289,7 +495,376 @@ func (g RealGitRunner) HasUnpulledChanges() (bool, error) {
 	return localHash != remoteHash, nil
 }
 
+// output runs a git command in the repo and returns its trimmed stdout
+func (g RealGitRunner) output(ctx context.Context, args ...string) (string, error) {
+	cmd := gitCommand(ctx, g.dir, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", gitSubcommand(args), msg)
+		}
+		return "", fmt.Errorf("git %s: %w", gitSubcommand(args), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitSubcommand returns the git subcommand in args, skipping leading `-c key=value` options
+func gitSubcommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-c" {
+			i++
+			continue
+		}
+		return args[i]
+	}
+	return ""
+}
+
+// revisionDateLayouts are the date formats accepted by ResolveRevision
+var revisionDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ResolveRevision turns a commit or a date into a commit hash
+//   - "2026-01-31" or an RFC3339 time means the last commit before that moment
+//   - anything else is treated as a git revision (hash, tag, HEAD~2, ...), even when it's all digits
+//
+// A number of pushes ago depends on the path, see PathVersions
+func (g RealGitRunner) ResolveRevision(ctx context.Context, at string) (string, error) {
+	for _, layout := range revisionDateLayouts {
+		t, err := time.ParseInLocation(layout, at, time.Local)
+		if err != nil {
+			continue
+		}
+		commit, err := g.output(ctx, "rev-list", "-1", "--first-parent", "--before="+t.Format(time.RFC3339), "HEAD")
+		if err != nil {
+			return "", err
+		}
+		if commit == "" {
+			return "", fmt.Errorf("no commit found before %s", at)
+		}
+		return commit, nil
+	}
+
+	commit, err := g.output(ctx, "rev-parse", "--verify", "--quiet", at+"^{commit}")
+	if err != nil {
+		if _, numErr := strconv.Atoi(at); numErr == nil {
+			return "", fmt.Errorf("unknown revision %q (use --ago %s for %s pushes ago)", at, at, at)
+		}
+		return "", fmt.Errorf("unknown revision %q (expected a commit or a date)", at)
+	}
+	return commit, nil
+}
+
+// ExportPath writes the content of path as it was in commit into destDir
+// Files keep their repository-relative location, so destDir/<path> mirrors the repo
+// Nothing in the working tree or the index is touched
+func (g RealGitRunner) ExportPath(ctx context.Context, commit, path, destDir string) error {
+	listing, err := g.output(ctx, "ls-tree", "-r", "-z", commit, "--", path)
+	if err != nil {
+		return err
+	}
+	if listing == "" {
+		return fmt.Errorf("%s does not exist in commit %s", path, shortHash(commit))
+	}
+
+	for _, entry := range strings.Split(strings.TrimRight(listing, "\x00"), "\x00") {
+		// ls-tree entry format: "<mode> <type> <object>\t<path>"
+		meta, file, found := strings.Cut(entry, "\t")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		mode, object := fields[0], fields[2]
+
+		content, err := g.blob(ctx, object)
+		if err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(destDir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return err
+		}
+
+		switch mode {
+		case "120000":
+			err = os.Symlink(string(content), destPath)
+		case "100755":
+			err = os.WriteFile(destPath, content, 0755)
+		default:
+			err = os.WriteFile(destPath, content, 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// blob returns the raw content of a git object
+func (g RealGitRunner) blob(ctx context.Context, object string) ([]byte, error) {
+	cmd := gitCommand(ctx, g.dir, "cat-file", "blob", object)
+	return cmd.Output()
+}
+
+// ReadFileAt returns the content of a file as it was in commit
+func (g RealGitRunner) ReadFileAt(ctx context.Context, commit, path string) ([]byte, error) {
+	return g.blob(ctx, commit+":"+path)
+}
+
+// StagedChanges returns the staged paths mapped to their status letter (A, M, D, ...)
+func (g RealGitRunner) StagedChanges(ctx context.Context) (map[string]string, error) {
+	listing, err := g.output(ctx, "diff", "--cached", "--name-status", "--no-renames", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	// -z output format: "<status>\x00<path>\x00<status>\x00<path>..."
+	changes := make(map[string]string)
+	fields := strings.Split(strings.TrimRight(listing, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes[fields[i+1]] = fields[i]
+	}
+	return changes, nil
+}
+
+// shortHash abbreviates a commit hash for display
+func shortHash(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
 // NewGitRunner creates a new GitRunner for the config folder
 func NewGitRunner() GitRunner {
 	return RealGitRunner{dir: configFolder().FullPath}
 }
+
+// Signing returns the signing settings the runner signs and verifies with
+func (g RealGitRunner) Signing() SigningConfig {
+	return g.signing
+}
+
+// NewConfiguredGitRunner creates a GitRunner that signs commits according to the config
+func NewConfiguredGitRunner(config *JsonConfig) (GitRunner, error) {
+	signing, err := config.SigningSettings()
+	if err != nil {
+		return nil, err
+	}
+	return RealGitRunner{dir: configFolder().FullPath, signing: signing}, nil
+}
+
+// PathCommits returns the commits on any branch that changed path, newest first
+func (g RealGitRunner) PathCommits(ctx context.Context, path string) ([]string, error) {
+	listing, err := g.output(ctx, "log", "--all", "--format=%H", "--", path)
+	if err != nil || listing == "" {
+		return nil, err
+	}
+	return strings.Split(listing, "\n"), nil
+}
+
+// PathVersions returns the commits of HEAD's first-parent history that changed path, newest first
+// These are the pushes and pulls that brought a new version of it, commits to other paths don't count
+func (g RealGitRunner) PathVersions(ctx context.Context, path string) ([]string, error) {
+	listing, err := g.output(ctx, "log", "--first-parent", "--format=%H", "HEAD", "--", path)
+	if err != nil || listing == "" {
+		return nil, err
+	}
+	return strings.Split(listing, "\n"), nil
+}
+
+// HistoryBlob is a file version stored in the git history
+type HistoryBlob struct {
+	Path   string
+	Object string
+	Size   int64
+}
+
+// RemovedBlobs lists the file versions below prefix that are in the history of main but not in HEAD
+// Versions of files that still exist in HEAD are left out, they can't be dropped without losing the file
+func (g RealGitRunner) RemovedBlobs(ctx context.Context, prefix string) ([]HistoryBlob, error) {
+	current, err := g.output(ctx, "ls-tree", "-r", "-z", "--name-only", "HEAD", "--", prefix)
+	if err != nil {
+		return nil, err
+	}
+	inHead := make(map[string]bool)
+	for _, path := range strings.Split(current, "\x00") {
+		inHead[path] = true
+	}
+
+	// rev-list output format: "<object> <path>", commits and the root tree have no path
+	objects, err := g.output(ctx, "rev-list", "--objects", "main")
+	if err != nil {
+		return nil, err
+	}
+	var blobs []HistoryBlob
+	var batch strings.Builder
+	for _, line := range strings.Split(objects, "\n") {
+		object, path, found := strings.Cut(line, " ")
+		if !found || !strings.HasPrefix(path, prefix) || inHead[path] {
+			continue
+		}
+		blobs = append(blobs, HistoryBlob{Path: path, Object: object})
+		batch.WriteString(object + "\n")
+	}
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+
+	// Directories show up in rev-list too, cat-file tells them apart and reports sizes
+	cmd := gitCommand(ctx, g.dir, "cat-file", "--batch-check=%(objecttype) %(objectsize)")
+	cmd.Stdin = strings.NewReader(batch.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != len(blobs) {
+		return nil, fmt.Errorf("git cat-file: expected %d objects, got %d", len(blobs), len(lines))
+	}
+	var files []HistoryBlob
+	for i, line := range lines {
+		kind, size, _ := strings.Cut(line, " ")
+		if kind != "blob" {
+			continue
+		}
+		blobs[i].Size, _ = strconv.ParseInt(size, 10, 64)
+		files = append(files, blobs[i])
+	}
+	return files, nil
+}
+
+// RewriteHistory removes paths from every commit of main, a bundle of the old history is written first
+// Commits that only touched those paths are dropped
+func (g RealGitRunner) RewriteHistory(ctx context.Context, paths []string, bundle string) error {
+	if status, err := g.output(ctx, "status", "--porcelain"); err != nil {
+		return err
+	} else if status != "" {
+		return fmt.Errorf("%s has uncommitted changes, run 'config-sync push' first", configFolder().TildePath)
+	}
+
+	log.Println("Saving the current history")
+	if err := os.MkdirAll(filepath.Dir(bundle), 0700); err != nil {
+		return err
+	}
+	if _, err := g.output(ctx, "bundle", "create", bundle, "--all"); err != nil {
+		return err
+	}
+
+	// The path list goes through a file, so no path is ever parsed by the shell
+	list, err := os.CreateTemp("", "config-sync-gc-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	_, err = list.WriteString(strings.Join(paths, "\x00"))
+	if closeErr := list.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("Rewriting the history of main")
+	filter := "git rm -r -q --cached --ignore-unmatch --pathspec-file-nul --pathspec-from-file='" + list.Name() + "'"
+	cmd := gitCommand(ctx, g.dir, "filter-branch", "--force", "--index-filter", filter, "--prune-empty", "--", "main")
+	cmd.Env = append(os.Environ(), "FILTER_BRANCH_SQUELCH_WARNING=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git filter-branch: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	// filter-branch keeps the old main in refs/original, which would keep every removed file alive
+	refs, err := g.output(ctx, "for-each-ref", "--format=%(refname)", "refs/original/")
+	if err != nil {
+		return err
+	}
+	for _, ref := range strings.Fields(refs) {
+		if _, err := g.output(ctx, "update-ref", "-d", ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForcePush replaces main on the remotes in leases, but only where it's still at the leased commit
+// That keeps a commit pushed from another machine in the meantime from being overwritten
+func (g RealGitRunner) ForcePush(ctx context.Context, leases map[string]string) error {
+	var failed []string
+	for _, remote := range slices.Sorted(maps.Keys(leases)) {
+		lease := "--force-with-lease=main:" + leases[remote]
+		log.Printf("Force pushing %s to %s\n", configFolder().TildePath, remote)
+		if err := g.run(ctx, "push", lease, remote, "main"); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v), retry with: git -C %s push %s %s main",
+				remote, err, configFolder().TildePath, lease, remote))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("force push failed for %s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// InHistory reports whether commit is part of HEAD's history
+func (g RealGitRunner) InHistory(ctx context.Context, commit string) bool {
+	_, err := g.output(ctx, "merge-base", "--is-ancestor", commit, "HEAD")
+	return err == nil
+}
+
+// Compact drops unreachable objects right away, including those still in the reflog
+func (g RealGitRunner) Compact(ctx context.Context) error {
+	if _, err := g.output(ctx, "reflog", "expire", "--expire=now", "--all"); err != nil {
+		return err
+	}
+	return g.run(ctx, "gc", "--prune=now", "--quiet")
+}
+
+// LogEntry is a commit with the paths it changed
+type LogEntry struct {
+	Commit  string
+	Time    time.Time
+	Profile string // Profile trailer, empty if the commit was made without a profile
+	Paths   []string
+}
+
+// PathLog returns the commits of HEAD that changed something below path, newest first
+func (g RealGitRunner) PathLog(ctx context.Context, path string) ([]LogEntry, error) {
+	// Every commit starts with a NUL, then "<hash>\t<unix time>\t<profile>" and the changed paths, one per line
+	listing, err := g.output(ctx, "log", "--format=%x00%H%x09%ct%x09%(trailers:key=Profile,valueonly,separator=%x2C)", "--name-only", "HEAD", "--", path)
+	if err != nil || listing == "" {
+		return nil, err
+	}
+
+	var entries []LogEntry
+	for _, record := range strings.Split(strings.TrimPrefix(listing, "\x00"), "\x00") {
+		lines := strings.Split(strings.TrimSpace(record), "\n")
+		fields := strings.SplitN(lines[0], "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entry := LogEntry{Commit: fields[0], Time: time.Unix(seconds, 0), Profile: strings.TrimSpace(fields[2])}
+		for _, line := range lines[1:] {
+			if line != "" {
+				entry.Paths = append(entry.Paths, line)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// testEnv is a sandbox for running config-sync commands: a temp home dir, a config folder
+// set through CONFIG_SYNC_HOME and an empty bare repository to use as origin
+type testEnv struct {
+	t      testing.TB
+	home   string // $HOME, ~ in tracked paths
+	folder string // The config folder
+	origin string // Bare repository
+}
+
+// newTestEnv creates the sandbox and points HOME and CONFIG_SYNC_HOME at it for the rest of the test
+func newTestEnv(t testing.TB) *testEnv {
+	t.Helper()
+	root := t.TempDir()
+	env := &testEnv{
+		t:      t,
+		home:   filepath.Join(root, "home"),
+		folder: filepath.Join(root, "home", ".config-sync-test"),
+		origin: filepath.Join(root, "origin.git"),
+	}
+	if err := os.MkdirAll(env.home, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOME", env.home)
+	t.Setenv("USERPROFILE", env.home)
+	t.Setenv("CONFIG_SYNC_HOME", env.folder)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(env.home, ".config"))
+	// Keep the user's git config and identity out of the sandbox
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(root, "gitconfig"))
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "Test")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "test@example.com")
+	}
+	t.Setenv("CONFIG_SYNC_PROFILE", "")
+	t.Setenv("NO_COLOR", "1")
+
+	env.git(root, "init", "--quiet", "--bare", "--initial-branch=main", env.origin)
+	return env
+}
+
+// run executes config-sync with args in this process and returns its exit code, stdout and log output
+func (e *testEnv) run(args ...string) (int, string, string) {
+	e.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resetCommandState()
+	setCommandContext(rootCmd, ctx)
+
+	stdout, restore := captureStdout(e.t)
+	var logs bytes.Buffer
+	setLogSink(&logs)
+	defer setLogSink(os.Stderr)
+	// Usage after a flag error
+	rootCmd.SetErr(&logs)
+	defer rootCmd.SetErr(nil)
+
+	code := execute(ctx, args)
+	return code, restore(stdout), logs.String()
+}
+
+// mustRun runs a command that has to succeed
+func (e *testEnv) mustRun(args ...string) string {
+	e.t.Helper()
+	code, stdout, logs := e.run(args...)
+	if code != 0 {
+		e.t.Fatalf("config-sync %s exited %d:\n%s", strings.Join(args, " "), code, logs)
+	}
+	return stdout
+}
+
+// setup initializes the config folder with origin as its primary remote
+func (e *testEnv) setup() {
+	e.t.Helper()
+	e.mustRun("init")
+	e.mustRun("set-origin-repo", e.origin, "--force")
+}
+
+// writeHome writes a file below the home dir and returns its tilde path
+func (e *testEnv) writeHome(name, content string) string {
+	e.t.Helper()
+	path := filepath.Join(e.home, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		e.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		e.t.Fatal(err)
+	}
+	return "~/" + filepath.ToSlash(name)
+}
+
+// git runs git in dir and returns its trimmed output
+func (e *testEnv) git(dir string, args ...string) string {
+	e.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		e.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// clone clones origin into a second working copy, for commits made "on another machine"
+func (e *testEnv) clone() string {
+	e.t.Helper()
+	dir := filepath.Join(e.t.TempDir(), "other")
+	e.git("", "clone", "--quiet", e.origin, dir)
+	return dir
+}
+
+// pushFromOther changes the synced copy of a tracked file in a second working copy, then commits and pushes it,
+// like another machine pushing its edit
+func (e *testEnv) pushFromOther(tildePath, content string) {
+	e.t.Helper()
+	other := e.clone()
+	synced := filepath.Join(other, "synced-files", md5Hash(tildePath), filepath.Base(tildePath))
+	if err := os.WriteFile(synced, []byte(content), 0644); err != nil {
+		e.t.Fatal(err)
+	}
+	e.git(other, "commit", "--quiet", "-am", "Change "+tildePath+" on another machine")
+	e.git(other, "push", "--quiet", "origin", "HEAD")
+}
+
+// resetCommandState undoes what an earlier run left in package state and flags,
+// cobra keeps flag values between executions of the same command tree
+func resetCommandState() {
+	appConfig = JsonConfig{}
+	appTimeouts = DefaultTimeouts()
+	timeoutFlags = map[string]string{}
+	configHome = ""
+	commandLock = nil
+	repoBusy = false
+	resultCommand = ""
+	resultStart = time.Now()
+	resultData = map[string]any{}
+	resultOnce = sync.Once{}
+	resetFlags(rootCmd)
+}
+
+func resetFlags(cmd *cobra.Command) {
+	reset := func(flag *pflag.Flag) {
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			slice.Replace(nil)
+		} else if flag.Value.Type() != "stringToString" {
+			flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
+	}
+}
+
+// setCommandContext hands ctx to every command, cobra only sets the context of a
+// subcommand on its first execution and would keep the cancelled one of an earlier run
+func setCommandContext(cmd *cobra.Command, ctx context.Context) {
+	cmd.SetContext(ctx)
+	for _, sub := range cmd.Commands() {
+		setCommandContext(sub, ctx)
+	}
+}
+
+// captureStdout redirects os.Stdout until the returned function is called with the pipe,
+// which restores it and returns what was written
+func captureStdout(t testing.TB) (*os.File, func(*os.File) string) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := os.Stdout
+	os.Stdout = writer
+
+	var output bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&output, reader)
+		close(done)
+	}()
+	return writer, func(w *os.File) string {
+		os.Stdout = original
+		w.Close()
+		<-done
+		reader.Close()
+		return output.String()
+	}
+}
+
+func TestConfigFolderFromEnvironment(t *testing.T) {
+	env := newTestEnv(t)
+	resetCommandState()
+
+	if got := configFolder().FullPath; got != env.folder {
+		t.Errorf("configFolder() = %s, want %s", got, env.folder)
+	}
+	if !customConfigFolder() {
+		t.Error("customConfigFolder() = false for a CONFIG_SYNC_HOME folder")
+	}
+
+	other := filepath.Join(env.home, "other")
+	configHome = other
+	defer func() { configHome = "" }()
+	if got := configFolder().FullPath; got != other {
+		t.Errorf("configFolder() with --home = %s, want %s", got, other)
+	}
+
+	t.Setenv("CONFIG_SYNC_HOME", "")
+	configHome = ""
+	if got, want := configFolder().FullPath, filepath.Join(env.home, ".config-sync"); got != want {
+		t.Errorf("configFolder() by default = %s, want %s", got, want)
+	}
+	if customConfigFolder() {
+		t.Error("customConfigFolder() = true for the default folder")
+	}
+}
+
+func TestShorthandPathUsesHome(t *testing.T) {
+	env := newTestEnv(t)
+
+	tests := []struct {
+		in        string
+		fullPath  string
+		tildePath string
+	}{
+		{"~/.zshrc", filepath.Join(env.home, ".zshrc"), "~/.zshrc"},
+		{"~", env.home, "~"},
+		{filepath.Join(env.home, ".config", "nvim"), filepath.Join(env.home, ".config", "nvim"), "~/.config/nvim"},
+		{env.home, env.home, "~"},
+		{filepath.Join(filepath.Dir(env.home), "elsewhere"), filepath.Join(filepath.Dir(env.home), "elsewhere"), filepath.Join(filepath.Dir(env.home), "elsewhere")},
+	}
+	for _, tt := range tests {
+		path := ShorthandPath{}.New(tt.in)
+		if path.FullPath != tt.fullPath || filepath.ToSlash(path.TildePath) != filepath.ToSlash(tt.tildePath) {
+			t.Errorf("New(%q) = {%s, %s}, want {%s, %s}", tt.in, path.FullPath, path.TildePath, tt.fullPath, tt.tildePath)
+		}
+	}
+}
+
+func TestSeparateConfigFolders(t *testing.T) {
+	env := newTestEnv(t)
+	env.setup()
+	personal := env.writeHome(".zshrc", "export EDITOR=vim\n")
+	env.mustRun("track", personal)
+
+	team := filepath.Join(env.home, ".config-sync-team")
+	teamFile := env.writeHome(".editorconfig", "root = true\n")
+	env.mustRun("--home", team, "init")
+	env.mustRun("--home", team, "track", teamFile)
+
+	var config JsonConfig
+	if err := config.Initialize(ShorthandPath{}.New(env.folder)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.Files[personal]; !ok || len(config.Files) != 1 {
+		t.Errorf("CONFIG_SYNC_HOME folder tracks %v, want only %s", config.Files, personal)
+	}
+	var teamConfig JsonConfig
+	if err := teamConfig.Initialize(ShorthandPath{}.New(team)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := teamConfig.Files[teamFile]; !ok || len(teamConfig.Files) != 1 {
+		t.Errorf("--home folder tracks %v, want only %s", teamConfig.Files, teamFile)
+	}
+}
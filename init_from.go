@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// InitFrom clones url into the config folder and loads the cloned config into config, adopting what's already there
+// An empty folder, or a fresh init without commits or tracked paths, is simply replaced. Anything else is moved
+// to .backups/init-from-<timestamp>/ of the clone and its tracked paths are merged into the cloned config.json,
+// with their synced copies, so the next push publishes them. reset skips the merge and starts from the clone alone.
+// local.json moves over unless reset is set
+func InitFrom(ctx context.Context, git GitRunner, config *JsonConfig, url string, reset bool) error {
+	folder := configFolder()
+	entries, err := os.ReadDir(folder.FullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) == 0 {
+		if err := git.Clone(ctx, url); err != nil {
+			return err
+		}
+		return loadOrCreateConfig(config, folder)
+	}
+
+	// A running watch or push must not see its folder move away
+	lock, err := AcquireRepoLock(folder, true, appTimeouts.LockWait)
+	if err != nil {
+		return err
+	}
+	var previous JsonConfig
+	if err := previous.Initialize(folder); err != nil && !os.IsNotExist(err) {
+		lock.Release()
+		return fmt.Errorf("reading the existing config failed: %w", err)
+	}
+	// Without .git, git would look for a repository in the parent folders
+	hasCommits := false
+	if _, err := os.Stat(folder.Suffix(".git").FullPath); err == nil {
+		_, headErr := git.ResolveRevision(ctx, "HEAD")
+		hasCommits = headErr == nil
+	}
+	fresh := !hasCommits && len(previous.Files) == 0
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	aside := ShorthandPath{}.New(folder.FullPath + ".init-from-" + stamp)
+	err = os.Rename(folder.FullPath, aside.FullPath)
+	lock.Release()
+	if err != nil {
+		return fmt.Errorf("moving the existing setup aside failed: %w", err)
+	}
+
+	if err := git.Clone(ctx, url); err != nil {
+		// Put the existing setup back, a failed clone may have left an empty folder
+		if removeErr := os.RemoveAll(folder.FullPath); removeErr == nil {
+			if renameErr := os.Rename(aside.FullPath, folder.FullPath); renameErr != nil {
+				return fmt.Errorf("%w (the existing setup is left in %s: %v)", err, aside.TildePath, renameErr)
+			}
+		}
+		return err
+	}
+	if err := loadOrCreateConfig(config, folder); err != nil {
+		return err
+	}
+
+	if !reset {
+		if err := copyIfMissing(ctx, aside.Suffix("local.json").FullPath, folder.Suffix("local.json").FullPath); err != nil {
+			return fmt.Errorf("keeping local.json failed: %w", err)
+		}
+	}
+	if fresh && !reset {
+		log.Printf("Replaced the empty setup in %s\n", folder.TildePath)
+		return os.RemoveAll(aside.FullPath)
+	}
+
+	if err := ensureLocalIgnores(folder); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+	backup := folder.Suffix(filepath.Join(".backups", "init-from-"+stamp))
+	if err := os.MkdirAll(filepath.Dir(backup.FullPath), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(aside.FullPath, backup.FullPath); err != nil {
+		return fmt.Errorf("moving the previous setup into %s failed, it's left in %s: %w", backup.TildePath, aside.TildePath, err)
+	}
+	log.Printf("Previous setup saved to %s\n", backup.TildePath)
+	if reset {
+		return nil
+	}
+	return mergeTrackedPaths(ctx, config, backup, previous.Files)
+}
+
+// loadOrCreateConfig loads the config of a clone, creating it when the repository has none
+func loadOrCreateConfig(config *JsonConfig, folder ShorthandPath) error {
+	err := config.Initialize(folder)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("config initialization failed: %w", err)
+	}
+	log.Printf("Config not found in cloned repository, creating new config...")
+	if err := config.Create(folder); err != nil {
+		return fmt.Errorf("config creation failed: %w", err)
+	}
+	return nil
+}
+
+// mergeTrackedPaths adds the tracked paths of a previous setup to the config, with their synced copies
+// Paths the config already tracks keep the cloned version
+func mergeTrackedPaths(ctx context.Context, config *JsonConfig, previous ShorthandPath, files map[string]string) error {
+	merged := 0
+	for _, tildePath := range slices.Sorted(maps.Keys(files)) {
+		if _, tracked := config.Files[tildePath]; tracked {
+			continue
+		}
+		config.Files[tildePath] = files[tildePath]
+
+		entry := filepath.Join("synced-files", md5Hash(tildePath))
+		source := previous.Suffix(entry).FullPath
+		if _, err := os.Stat(source); err == nil {
+			if err := copyDir(ctx, source, config.folder.Suffix(entry).FullPath); err != nil {
+				return fmt.Errorf("copying the synced copy of %s failed: %w", tildePath, err)
+			}
+		}
+		log.Printf("Merged local tracked path: %s\n", tildePath)
+		merged++
+	}
+	if merged == 0 {
+		return nil
+	}
+	if err := config.Save(); err != nil {
+		return err
+	}
+	log.Printf("Run 'config-sync push' to publish the %d merged %s\n", merged, plural(merged, "path", "paths"))
+	return nil
+}
+
+// copyIfMissing copies a file unless the source doesn't exist or the destination already does
+func copyIfMissing(ctx context.Context, src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	return copyFile(ctx, src, dst)
+}
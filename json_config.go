@@ -2,20 +2,28 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type JsonConfig struct {
 	Files       map[string]string `json:"files"`
+	Signing     *SigningConfig    `json:"signing,omitempty"`
+	Check       string            `json:"check_strategy,omitempty"`
+	Timeouts    map[string]string `json:"timeouts,omitempty"`
 	initialized bool
 	folder      ShorthandPath
 }
@@ -28,7 +36,7 @@ func (c *JsonConfig) IsInitialized() bool {
 // checkInitialized returns an error if the config is not initialized
 func (c *JsonConfig) checkInitialized() error {
 	if !c.initialized {
-		return errors.New("config not initialized. Call Initialize() first")
+		return fmt.Errorf("%w. Call Initialize() first", errNotInitialized)
 	}
 	return nil
 }
@@ -58,12 +66,29 @@ func (c *JsonConfig) Initialize(folder ShorthandPath) error {
 	return nil
 }
 
+// Reload reads the config from disk again, e.g. after a pull changed config.json
+func (c *JsonConfig) Reload() error {
+	if err := c.checkInitialized(); err != nil {
+		return err
+	}
+	var fresh JsonConfig
+	if err := fresh.Initialize(c.folder); err != nil {
+		return err
+	}
+	*c = fresh
+	return nil
+}
+
 // Create creates a new config at the given folder
 func (c *JsonConfig) Create(folder ShorthandPath) error {
 	if err := os.MkdirAll(folder.Suffix("synced-files").FullPath, 0755); err != nil && !errors.Is(err, os.ErrExist) {
 		return err
 	}
 
+	if err := ensureLocalIgnores(folder); err != nil {
+		return err
+	}
+
 	configPath := folder.Suffix("config.json")
 
 	var formattedJson bytes.Buffer
@@ -103,6 +128,11 @@ func (c *JsonConfig) Track(files []string) error {
 			continue
 		}
 
+		if insideFolder(c.folder.FullPath, path.FullPath) {
+			log.Printf("Skipping %s: it's inside the config folder %s\n", file, c.folder.TildePath)
+			continue
+		}
+
 		if _, exists := c.Files[path.TildePath]; exists {
 			log.Printf("Already tracked: %s\n", path.TildePath)
 			continue
@@ -115,6 +145,12 @@ func (c *JsonConfig) Track(files []string) error {
 	return c.Save()
 }
 
+// insideFolder reports whether path is folder itself or something in it
+func insideFolder(folder, path string) bool {
+	relative, err := filepath.Rel(folder, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
 // Untrack removes files from the config
 func (c *JsonConfig) Untrack(files []string) error {
 	if err := c.checkInitialized(); err != nil {
@@ -142,140 +178,188 @@ func md5Hash(s string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// copyFile copies a file from src to dst
-func copyFile(src, dst string) error {
+// copyFile copies a file from src to dst, keeping the source permissions
+func copyFile(ctx context.Context, src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
+	srcInfo, err := srcFile.Stat()
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	dstFile, err := os.Create(dst)
+	if err != nil {
 		return err
 	}
+	defer dstFile.Close()
 
-	return nil
-}
-
-// copyDir recursively copies a directory from src to dst
-func copyDir(src, dst string) error {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
+	watchdog := watchStall(srcFile, copyTimeout(ctx))
+	if err := watchdog.Stop(copyChunks(ctx, dstFile, srcFile, watchdog)); err != nil {
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+	if err := dstFile.Close(); err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
+	// Keep the modification time so the mtime/size check can compare both sides
+	if err := os.Chtimes(dst, srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
 		return err
 	}
+	return os.Chmod(dst, srcInfo.Mode().Perm())
+}
 
-	entries, err := os.ReadDir(src)
+// copyDir recursively copies a directory from src to dst, copying its files in parallel
+func copyDir(ctx context.Context, src, dst string) error {
+	copies, err := planDirCopy(src, dst)
 	if err != nil {
 		return err
 	}
+	return copyFiles(ctx, copies)
+}
 
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
+// trackedPaths returns the tracked paths in sorted order, so logs and results are stable
+func (c *JsonConfig) trackedPaths() []string {
+	paths := make([]string, 0, len(c.Files))
+	for tildePath := range c.Files {
+		paths = append(paths, tildePath)
 	}
-
-	return nil
+	sort.Strings(paths)
+	return paths
 }
 
 // SyncFiles copies tracked files to the synced-files folder
-func (c *JsonConfig) SyncFiles() error {
+// Files are copied in parallel, the log lists the tracked paths in sorted order once all are copied.
+// The new copy is built in .state/ and swapped in at the end, so a sync that fails or is
+// interrupted leaves synced-files as it was
+func (c *JsonConfig) SyncFiles(ctx context.Context) error {
 	if err := c.checkInitialized(); err != nil {
 		return err
 	}
 
-	syncDir := c.folder.Suffix("synced-files")
+	// Make sure machine-local files never end up in the commit
+	if err := ensureLocalIgnores(c.folder); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
 
-	// Clean synced-files folder (remove all contents)
-	if err := c.cleanSyncedFolder(syncDir.FullPath); err != nil {
-		return fmt.Errorf("failed to clean synced folder: %w", err)
+	staging := c.folder.Suffix(filepath.Join(".state", "synced-files.new"))
+	// Left behind by a sync that was killed
+	if err := os.RemoveAll(staging.FullPath); err != nil {
+		return fmt.Errorf("failed to clean %s: %w", staging.TildePath, err)
 	}
+	if err := os.MkdirAll(staging.FullPath, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging.FullPath)
+	syncDir := staging
 
-	// Copy each tracked file to its MD5-hashed subfolder
-	for tildePath := range c.Files {
+	// Lay out each tracked path's MD5-hashed subfolder, then copy all files in one pool
+	var copies []fileCopy
+	var synced []string
+	for _, tildePath := range c.trackedPaths() {
 		srcPath := ShorthandPath{}.New(tildePath)
 		hash := md5Hash(tildePath)
 		destDir := filepath.Join(syncDir.FullPath, hash)
+		destPath := filepath.Join(destDir, filepath.Base(srcPath.FullPath))
 
-		srcInfo, err := os.Stat(srcPath.FullPath)
+		srcInfo, err := statWithTimeout(srcPath.FullPath, appTimeouts.FileStat)
 		if err != nil {
 			return fmt.Errorf("failed to stat %s: %w", tildePath, err)
 		}
 
 		if srcInfo.IsDir() {
 			// For directories, copy the entire contents
-			destPath := filepath.Join(destDir, filepath.Base(srcPath.FullPath))
-			if err := copyDir(srcPath.FullPath, destPath); err != nil {
+			dirCopies, err := planDirCopy(srcPath.FullPath, destPath)
+			if err != nil {
 				return fmt.Errorf("failed to copy directory %s: %w", tildePath, err)
 			}
-			log.Printf("Synced directory: %s -> %s/%s\n", tildePath, hash, filepath.Base(srcPath.FullPath))
+			copies = append(copies, dirCopies...)
+			synced = append(synced, fmt.Sprintf("Synced directory: %s -> %s/%s", tildePath, hash, filepath.Base(srcPath.FullPath)))
 		} else {
 			// For files, copy the file
 			if err := os.MkdirAll(destDir, 0755); err != nil {
 				return fmt.Errorf("failed to create directory %s: %w", destDir, err)
 			}
-			destPath := filepath.Join(destDir, filepath.Base(srcPath.FullPath))
-			if err := copyFile(srcPath.FullPath, destPath); err != nil {
-				return fmt.Errorf("failed to copy %s: %w", tildePath, err)
-			}
-			log.Printf("Synced file: %s -> %s/%s\n", tildePath, hash, filepath.Base(srcPath.FullPath))
+			copies = append(copies, fileCopy{src: srcPath.FullPath, dst: destPath})
+			synced = append(synced, fmt.Sprintf("Synced file: %s -> %s/%s", tildePath, hash, filepath.Base(srcPath.FullPath)))
 		}
 	}
 
+	if err := copyFiles(ctx, copies); err != nil {
+		return fmt.Errorf("failed to copy tracked files: %w", err)
+	}
+	if err := c.replaceSyncedFolder(staging.FullPath); err != nil {
+		return fmt.Errorf("failed to replace synced folder: %w", err)
+	}
+	for _, line := range synced {
+		log.Println(line)
+	}
+
 	return nil
 }
 
-// cleanSyncedFolder removes all contents of the synced-files folder
-func (c *JsonConfig) cleanSyncedFolder(path string) error {
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
+// replaceSyncedFolder swaps a freshly built copy in place of the synced-files folder
+func (c *JsonConfig) replaceSyncedFolder(fresh string) error {
+	syncDir := c.folder.Suffix("synced-files").FullPath
+	old := c.folder.Suffix(filepath.Join(".state", "synced-files.old")).FullPath
+	if err := os.RemoveAll(old); err != nil {
 		return err
 	}
 
-	for _, entry := range entries {
-		fullPath := filepath.Join(path, entry.Name())
-		if err := os.RemoveAll(fullPath); err != nil {
-			return fmt.Errorf("failed to remove %s: %w", fullPath, err)
-		}
+	if err := os.Rename(syncDir, old); err != nil && !os.IsNotExist(err) {
+		return err
 	}
-
-	return nil
+	if err := os.Rename(fresh, syncDir); err != nil {
+		// Put the previous copy back
+		os.Rename(old, syncDir)
+		return err
+	}
+	return os.RemoveAll(old)
 }
 
 // RestoreFiles copies tracked files from synced-files back to their original locations
-func (c *JsonConfig) RestoreFiles() error {
+func (c *JsonConfig) RestoreFiles(ctx context.Context) error {
 	if err := c.checkInitialized(); err != nil {
 		return err
 	}
 
-	syncDir := c.folder.Suffix("synced-files")
+	return c.restoreFrom(ctx, c.folder.Suffix("synced-files").FullPath, c.trackedPaths(), NewBackupSession(c.folder), false)
+}
 
-	for tildePath := range c.Files {
+// restoreFrom copies the given tracked paths from a synced-files layout to their original locations
+// Existing destinations are backed up before being overwritten and keep their permissions.
+// With replace, a restored directory loses the files that aren't in the synced copy, as history restores need;
+// otherwise they're left alone.
+// A restore that fails or is interrupted is rolled back from the backups, so no path is left half restored
+func (c *JsonConfig) restoreFrom(ctx context.Context, syncDir string, paths []string, backups *BackupSession, replace bool) error {
+	if err := c.restorePaths(ctx, syncDir, paths, backups, replace); err != nil {
+		if rollbackErr := backups.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rolling back failed too: %v)", err, rollbackErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// restorePaths does the work of restoreFrom
+// Backups are taken one path at a time, then the files of all paths are copied in parallel
+func (c *JsonConfig) restorePaths(ctx context.Context, syncDir string, paths []string, backups *BackupSession, replace bool) error {
+	// A restored path whose permissions are put back and logged once every file is copied
+	type restored struct {
+		tildePath string
+		isDir     bool
+		keepMode  os.FileMode // Zero when the destination's permissions aren't kept
+	}
+	var copies []fileCopy
+	var done []restored
+
+	for _, tildePath := range paths {
 		destPath := ShorthandPath{}.New(tildePath)
 		hash := md5Hash(tildePath)
-		srcDir := filepath.Join(syncDir.FullPath, hash)
+		srcDir := filepath.Join(syncDir, hash)
 
 		// Check if hash folder exists
 		if _, err := os.Stat(srcDir); err != nil {
@@ -295,7 +379,7 @@ func (c *JsonConfig) RestoreFiles() error {
 		baseName := filepath.Base(destPath.FullPath)
 		srcPath := filepath.Join(srcDir, baseName)
 
-		srcInfo, err := os.Stat(srcPath)
+		srcInfo, err := statWithTimeout(srcPath, appTimeouts.FileStat)
 		if err != nil {
 			if os.IsNotExist(err) {
 				log.Printf("Skipping %s: source not found\n", tildePath)
@@ -304,26 +388,59 @@ func (c *JsonConfig) RestoreFiles() error {
 			return fmt.Errorf("failed to stat source for %s: %w", tildePath, err)
 		}
 
+		if err := backups.Backup(ctx, tildePath, srcPath); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", tildePath, err)
+		}
+
+		// Remember the destination's permissions so a restore doesn't loosen them
+		destInfo, destErr := statWithTimeout(destPath.FullPath, appTimeouts.FileStat)
+		entry := restored{tildePath: tildePath, isDir: srcInfo.IsDir()}
+		if destErr == nil && destInfo.IsDir() == srcInfo.IsDir() {
+			entry.keepMode = destInfo.Mode().Perm()
+		}
+
 		if srcInfo.IsDir() {
 			// For directories, copy the entire directory
 			// Remove destination first if it exists as a file
-			if destInfo, err := os.Stat(destPath.FullPath); err == nil && !destInfo.IsDir() {
+			if destErr == nil && !destInfo.IsDir() {
 				os.Remove(destPath.FullPath)
 			}
-			if err := copyDir(srcPath, destPath.FullPath); err != nil {
+			// Replacing starts from an empty directory, only once it's backed up so a rollback can bring it back
+			if _, saved := backups.saved[tildePath]; replace && saved && destErr == nil && destInfo.IsDir() {
+				if err := os.RemoveAll(destPath.FullPath); err != nil {
+					return fmt.Errorf("failed to replace directory %s: %w", tildePath, err)
+				}
+			}
+			dirCopies, err := planDirCopy(srcPath, destPath.FullPath)
+			if err != nil {
 				return fmt.Errorf("failed to restore directory %s: %w", tildePath, err)
 			}
-			log.Printf("Restored directory: %s\n", tildePath)
+			copies = append(copies, dirCopies...)
 		} else {
 			// For files, copy the file
 			// Remove destination first if it exists as a directory
-			if destInfo, err := os.Stat(destPath.FullPath); err == nil && destInfo.IsDir() {
+			if destErr == nil && destInfo.IsDir() {
 				os.RemoveAll(destPath.FullPath)
 			}
-			if err := copyFile(srcPath, destPath.FullPath); err != nil {
-				return fmt.Errorf("failed to restore file %s: %w", tildePath, err)
+			copies = append(copies, fileCopy{src: srcPath, dst: destPath.FullPath})
+		}
+		done = append(done, entry)
+	}
+
+	if err := copyFiles(ctx, copies); err != nil {
+		return fmt.Errorf("failed to restore tracked files: %w", err)
+	}
+
+	for _, entry := range done {
+		if entry.keepMode != 0 {
+			if err := os.Chmod(ShorthandPath{}.New(entry.tildePath).FullPath, entry.keepMode); err != nil {
+				return fmt.Errorf("failed to keep permissions of %s: %w", entry.tildePath, err)
 			}
-			log.Printf("Restored file: %s\n", tildePath)
+		}
+		if entry.isDir {
+			log.Printf("Restored directory: %s\n", entry.tildePath)
+		} else {
+			log.Printf("Restored file: %s\n", entry.tildePath)
 		}
 	}
 
@@ -333,36 +450,33 @@ func (c *JsonConfig) RestoreFiles() error {
 // HasUnsyncedChanges checks if any tracked source files have changed since last sync
 // Compares content hash of source files against synced-files/ versions
 // Non-destructive: doesn't modify any files
-func (c *JsonConfig) HasUnsyncedChanges() (bool, error) {
+func (c *JsonConfig) HasUnsyncedChanges(ctx context.Context) (bool, error) {
 	if err := c.checkInitialized(); err != nil {
 		return false, err
 	}
 
 	syncDir := c.folder.Suffix("synced-files")
 
-	for tildePath := range c.Files {
+	// Source and synced copy of each tracked path, hashed together in one pool
+	var targets []string
+	for _, tildePath := range c.trackedPaths() {
 		srcPath := ShorthandPath{}.New(tildePath)
-		hash := md5Hash(tildePath)
-		baseName := filepath.Base(srcPath.FullPath)
-		syncedPath := filepath.Join(syncDir.FullPath, hash, baseName)
+		syncedPath := filepath.Join(syncDir.FullPath, md5Hash(tildePath), filepath.Base(srcPath.FullPath))
+		targets = append(targets, srcPath.FullPath, syncedPath)
+	}
+	hashes, errs := hashPaths(ctx, targets, fileHash)
 
-		// Get source file hash
-		srcHash, err := fileHash(srcPath.FullPath)
-		if err != nil {
+	for i := 0; i < len(targets); i += 2 {
+		if errs[i] != nil {
 			// Source file doesn't exist or unreadable - consider it unchanged
 			// (user may have deleted it, we'll handle that on push)
 			continue
 		}
-
-		// Get synced file hash
-		syncedHash, err := fileHash(syncedPath)
-		if err != nil {
+		if errs[i+1] != nil {
 			// Synced file doesn't exist - file is new/changed
 			return true, nil
 		}
-
-		// Compare hashes
-		if srcHash != syncedHash {
+		if hashes[i] != hashes[i+1] {
 			return true, nil
 		}
 	}
@@ -385,3 +499,86 @@ func fileHash(path string) (string, error) {
 
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// hashPaths hashes files, or every file path and content of directories, spreading the files of all of them over the worker pool
+// Every path gets its own hash or error, one missing path doesn't fail the others
+func hashPaths(ctx context.Context, paths []string, fileHash func(string) (string, error)) ([]string, []error) {
+	hashes := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	isDir := make([]bool, len(paths))
+
+	// A file to hash, rel is its path inside the directory being hashed
+	type entry struct {
+		owner     int
+		rel, full string
+	}
+	var entries []entry
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if !info.IsDir() {
+			entries = append(entries, entry{owner: i, full: path})
+			continue
+		}
+
+		isDir[i] = true
+		errs[i] = filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{owner: i, rel: filepath.ToSlash(rel), full: p})
+			return nil
+		})
+	}
+
+	sums := make([]string, len(entries))
+	sumErrs := make([]error, len(entries))
+	err := forEachParallel(ctx, len(entries), func(ctx context.Context, j int) error {
+		if errs[entries[j].owner] == nil {
+			sums[j], sumErrs[j] = fileHash(entries[j].full)
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range errs {
+			errs[i] = cmp.Or(errs[i], err)
+		}
+		return hashes, errs
+	}
+
+	// Directory hashes are built in walk order, so they don't depend on which worker finished first
+	trees := make([]hash.Hash, len(paths))
+	for i := range paths {
+		if isDir[i] {
+			trees[i] = sha256.New()
+		}
+	}
+	for j, e := range entries {
+		switch {
+		case errs[e.owner] != nil:
+		case sumErrs[j] != nil:
+			errs[e.owner] = sumErrs[j]
+		case isDir[e.owner]:
+			fmt.Fprintf(trees[e.owner], "%s\x00%s\n", e.rel, sums[j])
+		default:
+			hashes[e.owner] = sums[j]
+		}
+	}
+	for i, tree := range trees {
+		if tree != nil && errs[i] == nil {
+			hashes[i] = hex.EncodeToString(tree.Sum(nil))
+		}
+	}
+
+	return hashes, errs
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// TrackedEntry describes a tracked path as it is synced and as it is on this machine
+type TrackedEntry struct {
+	Path       string     `json:"path"`
+	Type       string     `json:"type"`            // "file", "dir", or "unknown" when there is no copy anywhere
+	Size       int64      `json:"size"`            // Bytes, all files added up for directories
+	Files      int        `json:"files,omitempty"` // Only set for directories
+	Synced     bool       `json:"synced"`          // Whether synced-files holds a copy
+	LastSynced *time.Time `json:"last_synced,omitempty"`
+	Profile    string     `json:"profile,omitempty"` // Profile of the machine that last pushed it
+	Exists     bool       `json:"exists"`            // Whether the path exists on this machine
+}
+
+// ListTracked describes every tracked path, sorted by path
+// Type and size come from the synced copy, or from the local path while nothing is synced yet.
+// Last synced time and profile come from the last commit that changed the synced copy
+func ListTracked(ctx context.Context, git GitRunner, config *JsonConfig) ([]TrackedEntry, error) {
+	if err := config.checkInitialized(); err != nil {
+		return nil, err
+	}
+
+	lastCommits := lastSyncCommits(ctx, git)
+	var entries []TrackedEntry
+	for _, tildePath := range config.trackedPaths() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entry := TrackedEntry{Path: tildePath, Type: "unknown"}
+
+		_, err := statWithTimeout(ShorthandPath{}.New(tildePath).FullPath, appTimeouts.FileStat)
+		entry.Exists = err == nil
+
+		synced := config.folder.Suffix(filepath.Join("synced-files", md5Hash(tildePath), filepath.Base(tildePath))).FullPath
+		source := synced
+		if _, err := os.Lstat(synced); err == nil {
+			entry.Synced = true
+		} else if entry.Exists {
+			source = ShorthandPath{}.New(tildePath).FullPath
+		} else {
+			source = ""
+		}
+		if source != "" {
+			if err := entry.measure(source); err != nil {
+				return nil, err
+			}
+		}
+
+		if commit, ok := lastCommits[md5Hash(tildePath)]; ok {
+			entry.LastSynced = &commit.Time
+			entry.Profile = commit.Profile
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// measure fills in type, size and file count from a file or directory
+func (e *TrackedEntry) measure(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		e.Type = "file"
+		e.Size = info.Size()
+		return nil
+	}
+
+	e.Type = "dir"
+	return filepath.WalkDir(path, func(_ string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		e.Files++
+		e.Size += info.Size()
+		return nil
+	})
+}
+
+// lastSyncCommits maps every synced-files/<md5> entry to the last commit that changed it
+// Without history (nothing committed yet) the map is empty
+func lastSyncCommits(ctx context.Context, git GitRunner) map[string]LogEntry {
+	commits := make(map[string]LogEntry)
+	history, _ := git.PathLog(ctx, "synced-files")
+	for _, entry := range history {
+		for _, path := range entry.Paths {
+			// Unusual file names are quoted by git, the md5 folder never is
+			rest, found := strings.CutPrefix(strings.TrimPrefix(path, `"`), "synced-files/")
+			if !found {
+				continue
+			}
+			hash, _, _ := strings.Cut(rest, "/")
+			if _, seen := commits[hash]; !seen {
+				commits[hash] = entry
+			}
+		}
+	}
+	return commits
+}
+
+// FilterTracked keeps the entries missing on this machine when missing is set,
+// and the entries last pushed from profile when it isn't empty
+func FilterTracked(entries []TrackedEntry, missing bool, profile string) []TrackedEntry {
+	var kept []TrackedEntry
+	for _, entry := range entries {
+		if missing && entry.Exists {
+			continue
+		}
+		if profile != "" && entry.Profile != profile {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// WriteTrackedJSON writes the entries as a JSON array
+func WriteTrackedJSON(w io.Writer, entries []TrackedEntry) error {
+	if entries == nil {
+		entries = []TrackedEntry{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// WriteTrackedTable writes the entries as an aligned table
+func WriteTrackedTable(w io.Writer, entries []TrackedEntry) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PATH\tTYPE\tSIZE\tFILES\tLAST SYNCED\tPROFILE\tON THIS MACHINE")
+	for _, entry := range entries {
+		size, files, lastSynced, profile, exists := "-", "-", "never", "-", "missing"
+		if entry.Type != "unknown" {
+			size = formatSize(entry.Size)
+		}
+		if entry.Type == "dir" {
+			files = fmt.Sprint(entry.Files)
+		}
+		if entry.LastSynced != nil {
+			lastSynced = entry.LastSynced.Local().Format("2006-01-02 15:04")
+		}
+		if entry.Profile != "" {
+			profile = entry.Profile
+		}
+		if entry.Exists {
+			exists = "yes"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Path, entry.Type, size, files, lastSynced, profile, exists)
+	}
+	return table.Flush()
+}
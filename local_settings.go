@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LocalSettings holds machine-specific settings stored in ~/.config-sync/local.json
+// Unlike config.json it is never committed, so it's the place for per-machine keys and overrides
+type LocalSettings struct {
+	Signing *SigningConfig `json:"signing,omitempty"`
+	Check   string         `json:"check_strategy,omitempty"`
+	Notify  []string       `json:"notify,omitempty"`  // Where watch and the daemon report conflicts
+	Profile string         `json:"profile,omitempty"` // Profile this machine syncs as, CONFIG_SYNC_PROFILE overrides it
+}
+
+// LoadLocalSettings reads local.json from the config folder
+// A missing file is not an error, it just means there are no overrides
+func LoadLocalSettings(folder ShorthandPath) (LocalSettings, error) {
+	var settings LocalSettings
+	path := folder.Suffix("local.json")
+
+	content, err := os.ReadFile(path.FullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return settings, nil
+		}
+		return settings, fmt.Errorf("could not read the file %s: %w", path.TildePath, err)
+	}
+
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return settings, fmt.Errorf("could not parse the json from the file %s: %w", path.TildePath, err)
+	}
+	return settings, nil
+}
+
+// Save writes the settings to local.json in the config folder
+func (s LocalSettings) Save(folder ShorthandPath) error {
+	if err := ensureLocalIgnores(folder); err != nil {
+		return err
+	}
+	content, _ := json.MarshalIndent(s, "", "  ")
+	return os.WriteFile(folder.Suffix("local.json").FullPath, content, 0600)
+}
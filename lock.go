@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lock modes of commands, set as the "lock" annotation of a cobra command
+const (
+	LockShared    = "shared"    // Read-only checks, any number can run together
+	LockExclusive = "exclusive" // Commands that change synced-files, the git index or config.json
+	LockCheck     = "check"     // Read-only checks that must not stall: shared if the lock is free, otherwise none
+)
+
+// noLockWait makes AcquireRepoLock try once instead of waiting
+const noLockWait time.Duration = -1
+
+var (
+	// errLockBusy is returned by lockFile when another process holds a conflicting lock
+	errLockBusy = errors.New("lock busy")
+	// errLockUnsupported is returned by lockFile where flock isn't available, e.g. some network filesystems
+	errLockUnsupported = errors.New("file locking not supported")
+	// errRepoBusy is returned when the lock couldn't be acquired within the lock wait
+	errRepoBusy = errors.New("another config-sync run is using the repository")
+)
+
+// lockPollInterval is how often a busy lock is tried again
+const lockPollInterval = 50 * time.Millisecond
+
+// lockHolder identifies the process holding the exclusive lock, for error messages and stale lock detection
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+// RepoLock is an advisory lock on the config folder
+// Locks are released automatically if the process dies, except for the PID file fallback,
+// where a lock whose process is gone is detected as stale and taken over
+type RepoLock struct {
+	file    *os.File // flock'ed lock file
+	pidPath string   // PID lock file, used where flock isn't supported
+}
+
+// lockPath is the lock file of a config folder
+func lockPath(folder ShorthandPath) string {
+	return folder.Suffix(filepath.Join(".state", "lock")).FullPath
+}
+
+// AcquireRepoLock locks the config folder, waiting up to wait for other runs to finish
+// A wait of 0 waits as long as it takes, noLockWait doesn't wait at all
+func AcquireRepoLock(folder ShorthandPath, exclusive bool, wait time.Duration) (*RepoLock, error) {
+	path := lockPath(folder)
+	if err := ensureLocalIgnores(folder); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := lockFile(file, exclusive)
+		switch {
+		case err == nil:
+			if exclusive {
+				writeLockHolder(file)
+			}
+			return &RepoLock{file: file}, nil
+		case errors.Is(err, errLockUnsupported):
+			file.Close()
+			if !exclusive {
+				// Without flock there are no shared locks, readers go ahead unlocked
+				return &RepoLock{}, nil
+			}
+			return acquirePIDLock(path+".pid", wait)
+		case !errors.Is(err, errLockBusy):
+			file.Close()
+			return nil, err
+		}
+
+		if wait < 0 || (wait > 0 && time.Now().After(deadline)) {
+			holder := readLockHolder(path)
+			file.Close()
+			return nil, busyError(holder, wait)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// acquirePIDLock takes a lock by creating a file holding our PID
+// A lock file whose process is no longer running is stale and is removed
+func acquirePIDLock(path string, wait time.Duration) (*RepoLock, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			writeLockHolder(file)
+			file.Close()
+			return &RepoLock{pidPath: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		holder := readLockHolder(path)
+		if holder.PID != 0 && !processAlive(holder.PID) {
+			removeStalePIDLock(path, holder)
+			continue
+		}
+
+		if wait < 0 || (wait > 0 && time.Now().After(deadline)) {
+			return nil, busyError(holder, wait)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// removeStalePIDLock removes the PID lock file at path if it still holds the stale holder
+// Two runs can find the same stale lock, so it's first moved to a name of our own: only one rename succeeds,
+// and reading the moved file tells whether it was the stale lock or one a faster run created meanwhile
+func removeStalePIDLock(path string, stale lockHolder) {
+	moved := path + ".stale." + strconv.Itoa(os.Getpid())
+	if err := os.Rename(path, moved); err != nil {
+		// Gone already, another run took it over
+		return
+	}
+	holder := readLockHolder(moved)
+	if holder.PID == stale.PID && holder.Since.Equal(stale.Since) {
+		log.Printf("Removing stale lock left by pid %d (%s)\n", holder.PID, holder.Command)
+		os.Remove(moved)
+		return
+	}
+	// A live lock, put it back unless yet another run locked in the meantime
+	if err := os.Link(moved, path); err == nil || os.IsExist(err) {
+		os.Remove(moved)
+	} else {
+		os.Rename(moved, path)
+	}
+}
+
+// Release unlocks the config folder, it's safe to call on a nil lock
+func (l *RepoLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	if l.pidPath != "" {
+		// A run that wrongly took the lock over owns the file now, removing it would unlock that run
+		if holder := readLockHolder(l.pidPath); holder.PID != os.Getpid() {
+			return fmt.Errorf("lock %s is held by pid %d, not this run", l.pidPath, holder.PID)
+		}
+		return os.Remove(l.pidPath)
+	}
+	if l.file == nil {
+		return nil
+	}
+	// The file stays, removing a flock'ed file lets two processes lock different files
+	unlockFile(l.file)
+	return l.file.Close()
+}
+
+// writeLockHolder records the current process in the lock file
+func writeLockHolder(file *os.File) {
+	holder := lockHolder{PID: os.Getpid(), Command: strings.Join(os.Args[1:], " "), Since: time.Now()}
+	content, _ := json.Marshal(holder)
+	file.Truncate(0)
+	file.WriteAt(content, 0)
+}
+
+// readLockHolder reads who holds a lock, a zero holder means unknown
+func readLockHolder(path string) lockHolder {
+	var holder lockHolder
+	if content, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(content, &holder)
+	}
+	return holder
+}
+
+// busyError describes who holds the lock we gave up waiting for
+func busyError(holder lockHolder, wait time.Duration) error {
+	gaveUp := fmt.Sprintf("gave up after %s", wait)
+	if wait < 0 {
+		gaveUp = "didn't wait"
+	}
+	if holder.PID == 0 || !processAlive(holder.PID) {
+		return fmt.Errorf("%w (%s)", errRepoBusy, gaveUp)
+	}
+	return fmt.Errorf("%w: pid %d (config-sync %s) since %s (%s, see the lock_wait timeout)",
+		errRepoBusy, holder.PID, holder.Command, holder.Since.Format(time.TimeOnly), gaveUp)
+}
+
+// commandLock is the lock held by the running command, released after it finishes
+var commandLock *RepoLock
+
+// repoBusy is set when a LockCheck command runs without the lock because another run holds it
+var repoBusy bool
+
+// lockForCommand takes the lock a command's "lock" annotation asks for
+// Commands without the annotation lock on their own, like watch around each sync
+func lockForCommand(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	if _, err := os.Stat(configFolder().FullPath); os.IsNotExist(err) {
+		// Nothing to protect yet, the command reports the missing setup itself
+		return nil
+	}
+
+	wait := appTimeouts.LockWait
+	if mode == LockCheck {
+		wait = noLockWait
+	}
+	lock, err := AcquireRepoLock(configFolder(), mode == LockExclusive, wait)
+	if mode == LockCheck && errors.Is(err, errRepoBusy) {
+		debugf("%v, checking without the lock", err)
+		repoBusy = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	commandLock = lock
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile reports flock as unsupported, so the PID file lock is used
+func lockFile(file *os.File, exclusive bool) error {
+	return errLockUnsupported
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
+
+// processAlive reports whether a process exists, FindProcess fails for unknown PIDs on Windows
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
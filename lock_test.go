@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePIDLock writes a PID lock file for holder
+func writePIDLock(t *testing.T, path string, holder lockHolder) {
+	t.Helper()
+	content, _ := json.Marshal(holder)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPID returns the PID of a process that has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("git", "--version")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestPIDLockTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock.pid")
+	stale := lockHolder{PID: deadPID(t), Command: "push", Since: time.Now().Add(-time.Hour)}
+
+	// The stale lock was replaced by a live one after it was read, the live one stays
+	live := lockHolder{PID: os.Getpid(), Command: "pull", Since: time.Now()}
+	writePIDLock(t, path, live)
+	removeStalePIDLock(path, stale)
+	if holder := readLockHolder(path); holder.PID != live.PID {
+		t.Fatalf("live lock was removed, the file holds %+v", holder)
+	}
+
+	writePIDLock(t, path, stale)
+	lock, err := acquirePIDLock(path, noLockWait)
+	if err != nil {
+		t.Fatalf("stale lock wasn't taken over: %v", err)
+	}
+	if matches, _ := filepath.Glob(path + ".stale.*"); len(matches) != 0 {
+		t.Errorf("moved stale lock left behind: %v", matches)
+	}
+
+	// Another run took the lock from us, releasing must not unlock it
+	other := lockHolder{PID: deadPID(t), Command: "track", Since: time.Now()}
+	writePIDLock(t, path, other)
+	if err := lock.Release(); err == nil {
+		t.Error("releasing a lock held by another pid succeeded")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the other run's lock file is gone: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output settings, from --quiet, --verbose and --log-format
+var (
+	logQuiet   bool   // Only warnings and errors
+	logVerbose bool   // Also debug lines: git commands, their output and check timings
+	logFormat  string // "text" or "json"
+)
+
+// Log levels, from least to most important
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// logOutput formats and filters every line logged, whether through the log package or logAt
+type logOutput struct {
+	mu   sync.Mutex
+	sink io.Writer
+}
+
+// appLog receives all log output, the daemon points its sink at the log file
+var appLog = &logOutput{sink: os.Stderr}
+
+// setupLogging validates --log-format and routes the log package through appLog
+func setupLogging() error {
+	switch logFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", logFormat)
+	}
+	if logQuiet && logVerbose {
+		return errors.New("--quiet and --verbose can't be combined")
+	}
+	log.SetFlags(0)
+	log.SetOutput(logPackageWriter{})
+	return nil
+}
+
+// logPackageWriter turns log.Printf calls into info lines
+type logPackageWriter struct{}
+
+func (logPackageWriter) Write(p []byte) (int, error) {
+	appLog.write(levelInfo, string(p))
+	return len(p), nil
+}
+
+// logAt logs a message at the given level
+func logAt(level, format string, args ...any) {
+	appLog.write(level, fmt.Sprintf(format, args...))
+}
+
+// debugf logs a message that only shows with --verbose
+func debugf(format string, args ...any) {
+	logAt(levelDebug, format, args...)
+}
+
+func (l *logOutput) write(level, msg string) {
+	if level == levelDebug && !logVerbose || level == levelInfo && logQuiet {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if logFormat == "json" {
+		line, _ := json.Marshal(struct {
+			Type  string `json:"type"`
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{"log", now.Format(time.RFC3339Nano), level, msg})
+		l.sink.Write(append(line, '\n'))
+		return
+	}
+	fmt.Fprintf(l.sink, "%s %s\n", now.Format("2006/01/02 15:04:05"), msg)
+}
+
+// setLogSink sends all log output to w
+func setLogSink(w io.Writer) {
+	appLog.mu.Lock()
+	defer appLog.mu.Unlock()
+	appLog.sink = w
+}
+
+// lineLogger logs everything written to it line by line at debug level, with a prefix
+type lineLogger struct {
+	prefix  string
+	pending []byte
+}
+
+func (w *lineLogger) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexAny(w.pending, "\r\n")
+		if i < 0 {
+			return len(p), nil
+		}
+		if line := strings.TrimSpace(string(w.pending[:i])); line != "" {
+			debugf("%s%s", w.prefix, line)
+		}
+		w.pending = w.pending[i+1:]
+	}
+}
+
+// Flush logs a last line that didn't end with a newline
+func (w *lineLogger) Flush() {
+	if line := strings.TrimSpace(string(w.pending)); line != "" {
+		debugf("%s%s", w.prefix, line)
+	}
+	w.pending = nil
+}
+
+// commandResult is the final JSON object of a command run with --log-format json
+type commandResult struct {
+	Type       string         `json:"type"`
+	Time       string         `json:"time"`
+	Command    string         `json:"command"`
+	OK         bool           `json:"ok"`
+	ExitCode   int            `json:"exit_code"`
+	Error      string         `json:"error,omitempty"`
+	DurationMs int64          `json:"duration_ms"`
+	Data       map[string]any `json:"data,omitempty"`
+}
+
+// Collected while a command runs, written once by finishCommand
+var (
+	resultCommand string
+	resultStart   = time.Now()
+	resultData    = map[string]any{}
+	resultOnce    sync.Once
+)
+
+// setResult adds a value to the command's JSON result
+func setResult(key string, value any) {
+	resultData[key] = value
+}
+
+// finishCommand writes the JSON result, only the first call counts
+func finishCommand(exitCode int, err error) {
+	resultOnce.Do(func() {
+		if logFormat != "json" {
+			return
+		}
+		result := commandResult{
+			Type:       "result",
+			Time:       time.Now().Format(time.RFC3339Nano),
+			Command:    resultCommand,
+			OK:         exitCode == 0,
+			ExitCode:   exitCode,
+			DurationMs: time.Since(resultStart).Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if len(resultData) > 0 {
+			result.Data = resultData
+		}
+		line, _ := json.Marshal(result)
+		appLog.mu.Lock()
+		defer appLog.mu.Unlock()
+		appLog.sink.Write(append(line, '\n'))
+	})
+}
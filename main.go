@@ -1,10 +1,17 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -13,9 +20,21 @@ import (
 // Global config instance
 var appConfig JsonConfig
 
-// configFolder returns the ShorthandPath for ~/.config-sync
+// defaultConfigFolder is where the repository lives unless --home or CONFIG_SYNC_HOME says otherwise
+const defaultConfigFolder = "~/.config-sync"
+
+// configHome is the --home flag
+var configHome string
+
+// configFolder returns the ShorthandPath of the config folder: --home, else CONFIG_SYNC_HOME, else ~/.config-sync
 func configFolder() ShorthandPath {
-	return ShorthandPath{}.New("~/.config-sync")
+	return ShorthandPath{}.New(cmp.Or(configHome, strings.TrimSpace(os.Getenv("CONFIG_SYNC_HOME")), defaultConfigFolder))
+}
+
+// customConfigFolder reports whether the config folder isn't the default one,
+// jobs and hooks that run config-sync later then have to pass --home
+func customConfigFolder() bool {
+	return configFolder().FullPath != ShorthandPath{}.New(defaultConfigFolder).FullPath
 }
 
 // Cobra commands
@@ -26,70 +45,254 @@ var trackCmd = &cobra.Command{
 		"WARNING: Be careful not to track files containing secrets, API keys, passwords,\n" +
 		"or sensitive data. These files will be stored in a git repository and potentially\n" +
 		"shared with others. Only track configuration files that are safe to be public or\n" +
-		"shared within your trusted team.",
-	Args: cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		if err := appConfig.Track(args); err != nil {
-			log.Fatalf("Track failed: %v", err)
+		"shared within your trusted team.\n\n" +
+		"Pass - to read newline separated paths from stdin, e.g. for onboarding many files at once:\n" +
+		"  find ~/.config/nvim ~/.zshrc -maxdepth 0 | config-sync track -\n\n" +
+		"--interactive offers the dotfiles in ~ and the entries of ~/.config to pick from. Caches, shell\n" +
+		"history, files over 1 MiB, directories over 10 MiB and known secrets (~/.ssh, ~/.aws, *.pem, ...)\n" +
+		"are left out.\n\n" +
+		"--preset tracks the usual config locations of a tool on this OS, leaving out caches and files\n" +
+		"known to hold secrets: " + strings.Join(PresetNames(), ", ") + ".\n" +
+		"  config-sync track --preset zsh,git,vim",
+	Args: interactiveOrPaths,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		paths, err := pathArgs(args)
+		if err != nil {
+			return fmt.Errorf("track failed: %w", err)
 		}
+		var offered []string // Paths from --interactive and --preset
+		if interactive, _ := cmd.Flags().GetBool("interactive"); interactive {
+			candidates, err := TrackCandidates(cmd.Context(), &appConfig)
+			if err != nil {
+				return fmt.Errorf("track failed: %w", err)
+			}
+			labels := make([]string, len(candidates))
+			for i, candidate := range candidates {
+				labels[i] = candidate.Label()
+			}
+			picked, err := pickPaths(labels)
+			if err != nil {
+				return fmt.Errorf("track failed: %w", err)
+			}
+			for _, i := range picked {
+				offered = append(offered, candidates[i].TildePath)
+			}
+		}
+		if presets, _ := cmd.Flags().GetStringSlice("preset"); len(presets) > 0 {
+			plan, err := PlanPresets(presets)
+			if err != nil {
+				return fmt.Errorf("track failed: %w", err)
+			}
+			for _, skipped := range plan.Skipped {
+				logAt(levelWarn, "Not tracking %s", skipped)
+			}
+			for _, warning := range plan.Warnings {
+				logAt(levelWarn, "Warning: %s", warning)
+			}
+			offered = append(offered, plan.Paths...)
+		}
+		paths = append(paths, offered...)
+		if len(paths) == 0 {
+			log.Println("Nothing to track")
+			return nil
+		}
+		// Paths given by name are tracked as asked, only the ones the picker or a preset came up with are checked
+		if allow, _ := cmd.Flags().GetBool("allow-secrets"); !allow {
+			for _, path := range offered {
+				if secretPath(path) {
+					return &secretError{path}
+				}
+			}
+		}
+		if err := appConfig.Track(paths); err != nil {
+			return fmt.Errorf("track failed: %w", err)
+		}
+		setResult("paths", paths)
+		return nil
 	},
 }
 
 var untrackCmd = &cobra.Command{
 	Use:   "untrack [files...]",
 	Short: "Remove files from sync config",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		if err := appConfig.Untrack(args); err != nil {
-			log.Fatalf("Untrack failed: %v", err)
+	Long: "Stop tracking files. Their synced copies are removed from the repository by the next push.\n\n" +
+		"Pass - to read newline separated paths from stdin, or --interactive to pick from the tracked paths.",
+	Args: interactiveOrPaths,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		paths, err := pathArgs(args)
+		if err != nil {
+			return fmt.Errorf("untrack failed: %w", err)
+		}
+		if interactive, _ := cmd.Flags().GetBool("interactive"); interactive {
+			tracked := appConfig.trackedPaths()
+			picked, err := pickPaths(tracked)
+			if err != nil {
+				return fmt.Errorf("untrack failed: %w", err)
+			}
+			for _, i := range picked {
+				paths = append(paths, tracked[i])
+			}
 		}
+		if len(paths) == 0 {
+			log.Println("Nothing to untrack")
+			return nil
+		}
+		if err := appConfig.Untrack(paths); err != nil {
+			return fmt.Errorf("untrack failed: %w", err)
+		}
+		setResult("paths", paths)
+		return nil
 	},
 }
 
+// interactiveOrPaths requires paths unless --interactive or --preset is set
+func interactiveOrPaths(cmd *cobra.Command, args []string) error {
+	if presets, _ := cmd.Flags().GetStringSlice("preset"); len(presets) > 0 {
+		return nil
+	}
+	if interactive, _ := cmd.Flags().GetBool("interactive"); interactive {
+		if slices.Contains(args, "-") {
+			return usageErrorf("--interactive reads answers from stdin, it can't be combined with -")
+		}
+		return nil
+	}
+	return cobra.MinimumNArgs(1)(cmd, args)
+}
+
+// pathArgs replaces a - argument with the paths read from stdin
+func pathArgs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if arg != "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		read, err := readPaths(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading paths from stdin: %w", err)
+		}
+		paths = append(paths, read...)
+	}
+	return paths, nil
+}
+
+// pickPaths runs the picker on the terminal, the list goes to stderr so stdout stays clean
+func pickPaths(labels []string) ([]int, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return Pick(os.Stdin, os.Stderr, labels)
+}
+
 var pullCmd = &cobra.Command{
 	Use:   "pull",
 	Short: "Git pull and restore files to their locations",
-	Run: func(cmd *cobra.Command, args []string) {
-		git := NewGitRunner()
-		if err := git.Pull(); err != nil {
-			log.Fatalf("Pull failed: %v", err)
+	Long: "Pull the latest changes and restore tracked files to their original locations.\n\n" +
+		"With --verify-signatures (or signing.verify in config.json / local.json), incoming commits\n" +
+		"are fetched first and nothing is merged or restored unless every one of them is signed by\n" +
+		"a key listed in signing.trusted_keys of the current config.json.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		git, err := NewConfiguredGitRunner(&appConfig)
+		if err != nil {
+			return fmt.Errorf("loading signing settings failed: %w", err)
 		}
-		if err := appConfig.RestoreFiles(); err != nil {
-			log.Fatalf("Restore failed: %v", err)
+		verify, _ := cmd.Flags().GetBool("verify-signatures")
+		if err := pullAndRestore(cmd.Context(), git, &appConfig, verify); err != nil {
+			return fmt.Errorf("pull failed: %w", err)
 		}
 		log.Println("Pull and restore completed successfully")
+		return nil
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <path>",
+	Short: "Restore a tracked file from an older version",
+	Long: "Restore a single tracked file or directory from the git history to its original location.\n\n" +
+		"--at accepts a commit or a date, --ago a number of pushes that changed the path:\n" +
+		"  config-sync restore ~/.zshrc --ago 1           # The version before the current one\n" +
+		"  config-sync restore ~/.zshrc --at 2026-01-31   # The last version pushed before that date\n" +
+		"  config-sync restore ~/.zshrc --at 3f2a9c1      # The version in a specific commit\n\n" +
+		"The current file is backed up to ~/.config-sync/.backups/ before being overwritten.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if cmd.Flags().Changed("ago") {
+			ago, _ := cmd.Flags().GetInt("ago")
+			if ago < 0 {
+				return usageErrorf("--ago must not be negative")
+			}
+			err = appConfig.RestoreAgo(cmd.Context(), NewGitRunner(), args[0], ago)
+		} else {
+			at, _ := cmd.Flags().GetString("at")
+			err = appConfig.RestoreAt(cmd.Context(), NewGitRunner(), args[0], at)
+		}
+		if err != nil {
+			return fmt.Errorf("restore failed: %w", err)
+		}
+		log.Println("Restore completed successfully")
+		return nil
 	},
 }
 
 var pushCmd = &cobra.Command{
 	Use:   "push",
 	Short: "Sync tracked files and push to git",
-	Run: func(cmd *cobra.Command, args []string) {
-		git := NewGitRunner()
-
-		// Auto-init git repo if needed
-		if err := git.Init(); err != nil {
-			log.Fatalf("Git init failed: %v", err)
-		}
-
-		// Sync files to synced-folder
-		if err := appConfig.SyncFiles(); err != nil {
-			log.Fatalf("Sync failed: %v", err)
+	Long: "Copy tracked files into ~/.config-sync/synced-files, commit and push.\n\n" +
+		"The commit message lists the added, modified and deleted tracked paths, followed by\n" +
+		"Host, User, Profile and Config-Sync-Version trailers. Use -m to write your own subject.\n\n" +
+		"Commits are signed when signing.format is set to \"ssh\" or \"gpg\" in config.json or local.json.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		git, err := NewConfiguredGitRunner(&appConfig)
+		if err != nil {
+			return fmt.Errorf("loading signing settings failed: %w", err)
 		}
 
-		// Git add, commit, push
-		commitMsg := fmt.Sprintf("config-sync: update files [%s]", time.Now().UTC().Format(time.RFC3339))
-		if err := git.Add(); err != nil {
-			log.Fatalf("Git add failed: %v", err)
+		message, _ := cmd.Flags().GetString("message")
+		committed, err := commitLocalChanges(cmd.Context(), git, &appConfig, message)
+		if err != nil {
+			return fmt.Errorf("push failed: %w", err)
 		}
-		if err := git.Commit(commitMsg); err != nil {
-			log.Fatalf("Git commit failed: %v", err)
+		if !committed {
+			log.Println("No changes to commit")
 		}
-		if err := git.Push(); err != nil {
-			log.Fatalf("Push failed: %v", err)
+		setResult("committed", committed)
+		if err := pushCommits(cmd.Context(), git); err != nil {
+			return fmt.Errorf("push failed: %w", err)
 		}
 
 		log.Println("Push completed successfully")
+		return nil
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List tracked files and directories",
+	Long: "List every tracked path with its type, size, file count, when it was last pushed, the profile\n" +
+		"of the machine that pushed it, and whether it exists on this machine.\n\n" +
+		"Sizes are those of the synced copies, or of the local files for paths not pushed yet.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := ListTracked(cmd.Context(), NewGitRunner(), &appConfig)
+		if err != nil {
+			return fmt.Errorf("list failed: %w", err)
+		}
+		missing, _ := cmd.Flags().GetBool("missing")
+		profile, _ := cmd.Flags().GetString("profile")
+		entries = FilterTracked(entries, missing, profile)
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			WriteTrackedJSON(os.Stdout, entries)
+			return nil
+		}
+		if len(entries) == 0 {
+			log.Println("No tracked paths match")
+			return nil
+		}
+		WriteTrackedTable(os.Stdout, entries)
+		return nil
 	},
 }
 
@@ -100,15 +303,105 @@ var setOriginCmd = &cobra.Command{
 	Long: "Set the git remote origin for the synced-files repository.\n\n" +
 		"This initializes a git repository in ~/.config-sync/synced-files if it doesn't exist,\n" +
 		"then sets the remote origin to the provided URL.\n\n" +
+		"The URL is checked with ls-remote and must be empty or hold a config-sync repository\n" +
+		"(a config.json on main) that shares history with the local one. An existing origin is\n" +
+		"only changed with --replace.\n\n" +
 		"Example:\n  config-sync set-origin-repo git@github.com:user/config-repo.git",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		git := NewGitRunner()
+		replace, _ := cmd.Flags().GetBool("replace")
 		force, _ := cmd.Flags().GetBool("force")
-		if err := git.SetOrigin(args[0], force); err != nil {
-			log.Fatalf("Set origin failed: %v", err)
+		if err := git.SetOrigin(cmd.Context(), args[0], replace, force); err != nil {
+			return fmt.Errorf("set origin failed: %w", err)
 		}
 		log.Printf("Origin set to: %s\n", args[0])
 		log.Println("You can now use 'config-sync push' to sync your files.")
+		return nil
+	},
+}
+
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Manage the remotes config-sync pushes to and pulls from",
+	Long: "Manage named git remotes for the config repository.\n\n" +
+		"'origin' is the primary remote, every other remote is a mirror.\n" +
+		"push sends commits to every push-enabled remote, pull uses origin and\n" +
+		"falls back to the mirrors when origin is unreachable.\n\n" +
+		"Example:\n  config-sync remote add backup git@gitlab.com:user/config-repo.git",
+}
+
+var remoteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List remotes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remotes, err := NewGitRunner().Remotes(cmd.Context())
+		if err != nil {
+			return fmt.Errorf("listing remotes failed: %w", err)
+		}
+		if len(remotes) == 0 {
+			log.Println("No remotes configured. Run: config-sync set-origin-repo <url>")
+			return nil
+		}
+		for _, remote := range remotes {
+			role := "mirror"
+			if remote.Name == primaryRemote {
+				role = "primary"
+			}
+			push := "push"
+			if !remote.Push {
+				push = "no-push"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", remote.Name, remote.URL, role, push)
+		}
+		return nil
+	},
+}
+
+var remoteAddCmd = &cobra.Command{
+	Use:   "add <name> <url>",
+	Short: "Add a remote",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		noPush, _ := cmd.Flags().GetBool("no-push")
+		if err := NewGitRunner().AddRemote(cmd.Context(), args[0], args[1], !noPush); err != nil {
+			return fmt.Errorf("adding remote failed: %w", err)
+		}
+		log.Printf("Remote %s added: %s\n", args[0], args[1])
+		return nil
+	},
+}
+
+var remoteRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a remote",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := NewGitRunner().RemoveRemote(cmd.Context(), args[0]); err != nil {
+			return fmt.Errorf("removing remote failed: %w", err)
+		}
+		log.Printf("Remote %s removed\n", args[0])
+		return nil
+	},
+}
+
+var remoteSetURLCmd = &cobra.Command{
+	Use:   "set-url <name> <url>",
+	Short: "Change the URL of a remote",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		git := NewGitRunner()
+		if err := git.SetRemoteURL(cmd.Context(), args[0], args[1]); err != nil {
+			return fmt.Errorf("setting remote URL failed: %w", err)
+		}
+		if cmd.Flags().Changed("push") {
+			push, _ := cmd.Flags().GetBool("push")
+			if err := git.SetRemotePush(cmd.Context(), args[0], push); err != nil {
+				return fmt.Errorf("setting remote push failed: %w", err)
+			}
+		}
+		log.Printf("Remote %s set to: %s\n", args[0], args[1])
+		return nil
 	},
 }
 
@@ -122,17 +415,17 @@ var initCmd = &cobra.Command{
 		"  - synced-files/ directory for your configs\n" +
 		"  - Local git repository\n\n" +
 		"After init, use 'set-origin-repo' to connect to a remote repository.",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		git := NewGitRunner()
 
 		// Initialize git repo
-		if err := git.Init(); err != nil {
-			log.Fatalf("Git init failed: %v", err)
+		if err := git.Init(cmd.Context()); err != nil {
+			return fmt.Errorf("git init failed: %w", err)
 		}
 
 		// Create config
 		if err := appConfig.Create(configFolder()); err != nil {
-			log.Fatalf("Config creation failed: %v", err)
+			return fmt.Errorf("config creation failed: %w", err)
 		}
 
 		log.Printf("\n✓ config-sync initialized at %s\n", configFolder().TildePath)
@@ -140,6 +433,7 @@ var initCmd = &cobra.Command{
 		log.Printf("  config-sync set-origin-repo <url>  # Connect to a remote repo")
 		log.Printf("  config-sync track ~/.vimrc          # Start tracking files")
 		log.Printf("  config-sync push                    # Push to remote")
+		return nil
 	},
 }
 
@@ -149,44 +443,71 @@ var initFromCmd = &cobra.Command{
 	Long: "Clone an existing config-sync repository from a git URL.\n\n" +
 		"This will clone the repository into ~/.config-sync, making it ready to use.\n" +
 		"Use this on a new machine to quickly set up config-sync.\n\n" +
+		"An existing ~/.config-sync is adopted: a fresh 'init' without commits or tracked files is\n" +
+		"replaced, anything else is saved to ~/.config-sync/.backups/init-from-<time>/ and its tracked\n" +
+		"paths are merged into the cloned config.json, to be published by the next push.\n" +
+		"--reset skips the merge and starts from the clone alone (the old setup is still saved).\n\n" +
 		"Example:\n  config-sync init-from git@github.com:user/config-repo.git",
 	Args: cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		git := NewGitRunner()
+	RunE: func(cmd *cobra.Command, args []string) error {
 		force, _ := cmd.Flags().GetBool("force")
+		reset, _ := cmd.Flags().GetBool("reset")
 
 		// Security check: warn if repo appears to be public
 		if !force {
-			if httpsURL := sshToHTTPS(args[0]); httpsURL != "" {
-				if isPublicRepo(httpsURL) {
-					log.Printf("⚠️  WARNING: Repository appears to be publicly accessible!\n")
-					log.Printf("If this repo contains sensitive configs, use --force only if you understand the risks.")
-					return
-				}
+			if err := refusePublicRepo(args[0]); err != nil {
+				return err
 			}
 		}
 
-		if err := git.Clone(args[0]); err != nil {
-			log.Fatalf("Clone failed: %v", err)
-		}
-
-		// Load the config after cloning
-		if err := appConfig.Initialize(configFolder()); err != nil {
-			if os.IsNotExist(err) {
-				// Config doesn't exist in cloned repo, create it
-				log.Printf("Config not found in cloned repository, creating new config...")
-				if err := appConfig.Create(configFolder()); err != nil {
-					log.Fatalf("Config creation failed: %v", err)
-				}
-			} else {
-				log.Fatalf("Config initialization failed: %v", err)
-			}
+		if err := InitFrom(cmd.Context(), NewGitRunner(), &appConfig, args[0], reset); err != nil {
+			return fmt.Errorf("init-from failed: %w", err)
 		}
 
 		log.Printf("\n✓ Repository cloned successfully!")
 		log.Printf("You can now use:")
 		log.Printf("  config-sync pull    # To sync files from the repo")
 		log.Printf("  config-sync track  # To add new files to track")
+		return nil
+	},
+}
+
+var bootstrapCmd = &cobra.Command{
+	Use:   "bootstrap <url>",
+	Short: "Set up this machine from a config-sync repository in one step",
+	Long: "Clone the repository into ~/.config-sync, save the profile, restore every tracked path and\n" +
+		"install the prompt hook, then print a summary. Meant for dev containers, cloud-init and setup scripts.\n\n" +
+		"Existing files that differ from the synced copies are backed up to ~/.config-sync/.backups/ and\n" +
+		"replaced, after asking; --yes replaces them without asking. Running it again is safe: it pulls\n" +
+		"instead of cloning and only restores what changed. An existing setup without an origin is adopted\n" +
+		"like init-from does.\n\n" +
+		"The prompt hook is added to the startup file of the shell in $SHELL (or --shell), unless it's\n" +
+		"already there.\n\n" +
+		"Example:\n  config-sync bootstrap git@github.com:user/config-repo.git --profile work --yes",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options := BootstrapOptions{URL: args[0]}
+		options.Profile, _ = cmd.Flags().GetString("profile")
+		options.Yes, _ = cmd.Flags().GetBool("yes")
+		options.Force, _ = cmd.Flags().GetBool("force")
+		options.Shell, _ = cmd.Flags().GetString("shell")
+		if options.Shell != "" && options.Shell != "none" && !slices.Contains(promptShells, options.Shell) {
+			return usageErrorf("unsupported shell %q (supported: %s, none)", options.Shell, strings.Join(promptShells, ", "))
+		}
+
+		summary, err := Bootstrap(cmd.Context(), &appConfig, options, func(paths []string) bool {
+			fmt.Println("These files exist and differ from the synced copies:")
+			for _, path := range paths {
+				fmt.Printf("  %s\n", path)
+			}
+			return confirm(os.Stdin, "They are backed up before being replaced.", "yes")
+		})
+		setResult("bootstrap", summary)
+		if err != nil {
+			return fmt.Errorf("bootstrap failed: %w", err)
+		}
+		WriteBootstrapSummary(os.Stdout, summary)
+		return nil
 	},
 }
 
@@ -195,63 +516,551 @@ var checkUpdatesCmd = &cobra.Command{
 	Short: "Check if config is out of sync",
 	Long: "Check if there are unpushed local changes or unpulled remote changes.\n\n" +
 		"This is a lightweight check that doesn't modify any files.\n" +
-		"Useful for running in shell prompts or startup scripts.\n\n" +
+		"Useful for running in shell prompts or startup scripts; for a compact prompt glyph,\n" +
+		"see prompt-segment and shell-hook.\n\n" +
+		"The default cached-state strategy answers from ~/.config-sync/.state/ with stat calls\n" +
+		"and a cached remote head, refreshing the remote head in the background every 5 minutes.\n\n" +
 		"Exits silently if not initialized.\n\n" +
-		"Operations are timed and logged with millisecond precision.",
-	Run: func(cmd *cobra.Command, args []string) {
-		git := NewGitRunner()
+		"Unsynced source files are detected with a pluggable strategy (--strategy, or\n" +
+		"check_strategy in config.json / local.json). Use --benchmark to compare them.\n\n" +
+		statusOutputHelp + "\n\n" +
+		"Operations are timed with millisecond precision. Use --timings (or --verbose) to log them\n" +
+		"to stderr, or --timings=json for a JSON array.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStatusCheck(cmd, true)
+	},
+}
 
-		// Check if git repo exists
-		if _, err := os.Stat(filepath.Join(configFolder().FullPath, ".git")); os.IsNotExist(err) {
-			return // Silent exit if not initialized
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the sync status of tracked files",
+	Long: "Show which tracked files changed and whether there is anything to push or pull.\n\n" +
+		"Runs the same checks as check-updates, but always reports, also when everything is up to date.\n\n" +
+		statusOutputHelp,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStatusCheck(cmd, false)
+	},
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the installation and suggest fixes",
+	Long: "Check git, the config repository, its remotes, config.json and the tracked files, and print a fix for every problem found.\n\n" +
+		"Exits with 1 if any check failed, warnings alone exit with 0.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		checks := RunDoctor(cmd.Context(), configFolder())
+		setResult("checks", checks)
+		for _, check := range checks {
+			fmt.Printf("%s %-14s %s\n", check.Symbol(), check.Name, check.Detail)
+			if check.Fix != "" {
+				fmt.Printf("  %-14s Fix: %s\n", "", check.Fix)
+			}
 		}
+		if DoctorFailed(checks) {
+			return silentExit(ExitError)
+		}
+		return nil
+	},
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find and remove orphaned synced files",
+	Long: "List the entries in ~/.config-sync/synced-files that belong to no tracked path. Their original\n" +
+		"path is looked up in older versions of config.json.\n\n" +
+		"--remove deletes them and commits the removal, without pushing.\n\n" +
+		"--prune-history drops files that are no longer synced from the whole history of main, to shrink\n" +
+		"the repository. This rewrites history and force pushes it, so it asks for confirmation first and\n" +
+		"saves the old history as a bundle in ~/.config-sync/.backups/. Other machines have to reset to\n" +
+		"the new history afterwards.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		git, err := NewConfiguredGitRunner(&appConfig)
+		if err != nil {
+			return fmt.Errorf("loading signing settings failed: %w", err)
+		}
+
+		orphans, err := FindOrphans(cmd.Context(), git, &appConfig)
+		if err != nil {
+			return fmt.Errorf("gc failed: %w", err)
+		}
+		setResult("orphans", orphans)
+		remove, _ := cmd.Flags().GetBool("remove")
+		switch {
+		case len(orphans) == 0:
+			log.Println("No orphaned entries in synced-files")
+		case remove:
+			if err := RemoveOrphans(cmd.Context(), git, &appConfig, orphans); err != nil {
+				return fmt.Errorf("gc failed: %w", err)
+			}
+			log.Println("Removed orphaned entries, run 'config-sync push' to publish the removal")
+		default:
+			for _, orphan := range orphans {
+				fmt.Printf("%s\t%s\t%s\n", orphan.Hash, formatSize(orphan.Size), orphan.Label())
+			}
+			log.Println("Run 'config-sync gc --remove' to delete them")
+		}
+
+		if prune, _ := cmd.Flags().GetBool("prune-history"); !prune {
+			return nil
+		}
+		minSize, _ := cmd.Flags().GetInt64("min-size")
+		files, err := FindRemovedFiles(cmd.Context(), git, minSize)
+		if err != nil {
+			return fmt.Errorf("gc failed: %w", err)
+		}
+		if len(files) == 0 {
+			log.Printf("No removed files of %s or more in the history\n", formatSize(minSize))
+			return nil
+		}
+		var total int64
+		for _, file := range files {
+			fmt.Printf("%s\t%d %s\t%s\n", formatSize(file.Size), file.Versions, plural(file.Versions, "version", "versions"), file.Label())
+			total += file.Size
+		}
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+			fmt.Printf("\nThis removes the files above (%s) from every commit and force pushes main to every push remote.\n"+
+				"Other machines then have to run: git -C %s fetch origin && git -C %s reset --hard origin/main\n",
+				formatSize(total), configFolder().TildePath, configFolder().TildePath)
+			if !confirm(os.Stdin, "Rewrite history?", "rewrite") {
+				return errors.New("history left unchanged")
+			}
+		}
+		if err := PruneHistory(cmd.Context(), git, configFolder(), files); err != nil {
+			return fmt.Errorf("pruning history failed: %w", err)
+		}
+		log.Println("History rewritten and pushed")
+		return nil
+	},
+}
 
-		// Load config to check for unsynced source files
-		_ = appConfig.Initialize(configFolder())
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Push and pull automatically as tracked files change",
+	Long: "Watch every tracked path (directories recursively) and push as soon as edits settle.\n" +
+		"Remote changes are pulled and restored every --pull-interval.\n\n" +
+		"To stay safe, local edits are committed before anything is pulled, remote changes aren't\n" +
+		"restored while local edits are still coming in, and a merge conflict pauses syncing until\n" +
+		"it's resolved. When the remote is unreachable, retries back off up to 10 minutes.\n\n" +
+		"Stop with Ctrl-C; pending edits are synced before exiting. 'config-sync status' shows\n" +
+		"the state of a running watch.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options := DefaultWatchOptions()
+		options.Debounce, _ = cmd.Flags().GetDuration("debounce")
+		options.PullInterval, _ = cmd.Flags().GetDuration("pull-interval")
+		if options.Debounce < 0 || options.PullInterval <= 0 {
+			return usageErrorf("--debounce and --pull-interval must be positive")
+		}
 
-		// Create timing logger (always enabled)
-		logger := NewTimingLogger("[check-updates] ", true)
+		if err := RunWatch(cmd.Context(), &appConfig, options); err != nil {
+			return fmt.Errorf("watch failed: %w", err)
+		}
+		return nil
+	},
+}
 
-		// Create check strategy with all optimizations
-		syncDir := filepath.Join(configFolder().FullPath, "synced-files")
-		checker := NewCheckStrategy(git, &appConfig, syncDir, logger)
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Sync on a schedule in the background",
+	Long: "Install a background job that pulls and pushes on a schedule, like one sync of 'watch'\n" +
+		"every --interval. It uses a systemd user timer when systemd is running, and the user's\n" +
+		"crontab otherwise. Runs log to ~/.config-sync/.state/daemon.log.\n\n" +
+		"Merge conflicts pause syncing and are reported through the notifiers in local.json\n" +
+		"(\"notify\": stdout, desktop, or a webhook URL), set with 'daemon install --notify'.",
+}
 
-		// Run checks
-		hasUnsynced, _ := checker.CheckUnsyncedFiles()
-		hasUnpushed, _ := checker.CheckUnpushed()
-		hasUnpulled, _ := checker.CheckUnpulled()
+var daemonInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install and start the scheduled sync",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval, _ := cmd.Flags().GetDuration("interval")
+		if interval < time.Minute {
+			return usageErrorf("--interval must be at least 1m")
+		}
+		notify, _ := cmd.Flags().GetStringSlice("notify")
+		for _, spec := range notify {
+			if _, err := NewNotifier(spec); err != nil {
+				return fmt.Errorf("install failed: %w", err)
+			}
+		}
 
-		if !hasUnsynced && !hasUnpushed && !hasUnpulled {
-			return // Silent exit - everything up to date
+		method, _ := cmd.Flags().GetString("method")
+		root, _ := cmd.Flags().GetString("root")
+		scheduler, err := newScheduler(method, root)
+		if err != nil {
+			return fmt.Errorf("install failed: %w", err)
+		}
+		job, err := NewDaemonJob(interval)
+		if err != nil {
+			return fmt.Errorf("install failed: %w", err)
+		}
+		if err := scheduler.Install(job); err != nil {
+			return fmt.Errorf("install failed: %w", err)
 		}
 
-		// Build message
-		var msgs []string
-		if hasUnsynced || hasUnpushed || hasUnpulled {
-			msgs = append(msgs, "Your config is out of sync:")
-			if hasUnsynced {
-				msgs = append(msgs, "  • Some tracked files have changed")
+		if cmd.Flags().Changed("notify") {
+			settings, err := LoadLocalSettings(configFolder())
+			if err != nil {
+				return fmt.Errorf("saving notifiers failed: %w", err)
 			}
-			if hasUnpushed {
-				msgs = append(msgs, "  • You have local changes not pushed")
+			settings.Notify = notify
+			if err := settings.Save(configFolder()); err != nil {
+				return fmt.Errorf("saving notifiers failed: %w", err)
 			}
-			if hasUnpulled {
-				msgs = append(msgs, "  • There are remote changes not pulled")
+		}
+		log.Printf("Installed with %s, syncing every %s\n", scheduler.Name(), interval)
+		log.Printf("Logs: %s\n", job.LogFile)
+		return nil
+	},
+}
+
+var daemonUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stop and remove the scheduled sync",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		method, _ := cmd.Flags().GetString("method")
+		root, _ := cmd.Flags().GetString("root")
+		scheduler, err := installedScheduler(method, root)
+		if err != nil {
+			return fmt.Errorf("uninstall failed: %w", err)
+		}
+		if !scheduler.Installed() {
+			log.Println("The daemon is not installed")
+			return nil
+		}
+		if err := scheduler.Uninstall(); err != nil {
+			return fmt.Errorf("uninstall failed: %w", err)
+		}
+		log.Printf("Removed the %s job\n", scheduler.Name())
+		return nil
+	},
+}
+
+var daemonStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the scheduled sync is installed and how its last run went",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		method, _ := cmd.Flags().GetString("method")
+		root, _ := cmd.Flags().GetString("root")
+		scheduler, err := installedScheduler(method, root)
+		if err != nil {
+			return fmt.Errorf("status failed: %w", err)
+		}
+		fmt.Printf("Scheduler: %s (%s)\n", scheduler.Name(), scheduler.Status())
+
+		state := LoadDaemonState(configFolder())
+		if state.LastRun.IsZero() {
+			fmt.Println("Last run:  never")
+		} else {
+			fmt.Printf("Last run:  %s (%s)\n", state.LastRun.Format(time.DateTime), state.Result)
+			if state.Error != "" {
+				firstLine, _, _ := strings.Cut(state.Error, "\n")
+				fmt.Printf("Error:     %s\n", firstLine)
 			}
-			msgs = append(msgs, "")
-			msgs = append(msgs, "Run: config-sync push")
 		}
+		fmt.Printf("Log file:  %s\n", daemonLogPath(configFolder()))
+		return nil
+	},
+}
 
-		for _, msg := range msgs {
-			log.Println(msg)
+var daemonRunCmd = &cobra.Command{
+	Use:    "run",
+	Short:  "Run one scheduled sync (used by the installed job)",
+	Args:   cobra.NoArgs,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if logFile, _ := cmd.Flags().GetString("log-file"); logFile != "" {
+			if err := openDaemonLog(logFile); err != nil {
+				return fmt.Errorf("opening log file failed: %w", err)
+			}
+		}
+		notifier, err := LoadNotifier(configFolder())
+		if err != nil {
+			return fmt.Errorf("loading notifiers failed: %w", err)
 		}
+
+		// Offline or busy is normal, only conflicts and real failures fail the run
+		// The cycle already logged its error
+		var netErr *networkError
+		if err := RunDaemonCycle(cmd.Context(), &appConfig, notifier); err != nil && !errors.As(err, &netErr) && !errors.Is(err, errRepoBusy) {
+			return silentExit(exitCode(err))
+		}
+		return nil
+	},
+}
+
+var promptSegmentCmd = &cobra.Command{
+	Use:   "prompt-segment",
+	Short: "Print a compact sync status for shell prompts",
+	Long: "Print the sync status as glyphs for a shell prompt, e.g. \"⇡2 ⇣1 ✎\":\n" +
+		"  ⇡N  N local commits not pushed\n" +
+		"  ⇣N  N remote commits not pulled (⇣ alone when they aren't fetched yet)\n" +
+		"  ✎   tracked files changed since the last push\n\n" +
+		"Prints nothing when in sync or not initialized. Answers from cached state and never\n" +
+		"contacts the remote; a stale remote head is refreshed in the background.\n\n" +
+		"Use shell-hook to run it asynchronously from your prompt.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shell, _ := cmd.Flags().GetString("shell")
+		if shell != "" && !slices.Contains(promptShells, shell) {
+			return usageErrorf("unsupported shell %q (supported: %s)", shell, strings.Join(promptShells, ", "))
+		}
+		noColor, _ := cmd.Flags().GetBool("no-color")
+		_, noColorEnv := os.LookupEnv("NO_COLOR")
+
+		// A prompt must never fail, so anything that isn't set up yet just prints nothing
+		if err := appConfig.Initialize(configFolder()); err != nil || !appConfig.IsInitialized() {
+			return nil
+		}
+		if timeouts, err := ResolveTimeouts(&appConfig); err == nil {
+			appTimeouts = timeouts
+		}
+
+		status := ReadPromptStatus(cmd.Context(), &appConfig, configFolder().Suffix("synced-files").FullPath)
+		fmt.Print(status.Segment(shell, !noColor && !noColorEnv))
+		return nil
+	},
+}
+
+var shellHookCmd = &cobra.Command{
+	Use:   "shell-hook <bash|zsh|fish>",
+	Short: "Print a snippet that shows the sync status in your prompt",
+	Long: "Print a snippet that runs prompt-segment in the background on every prompt and shows\n" +
+		"the result in front of your prompt. The prompt never waits for the check.\n\n" +
+		"  bash: eval \"$(config-sync shell-hook bash)\"   # in ~/.bashrc\n" +
+		"  zsh:  eval \"$(config-sync shell-hook zsh)\"    # in ~/.zshrc\n" +
+		"  fish: config-sync shell-hook fish | source     # in ~/.config/fish/config.fish\n\n" +
+		"zsh and fish redraw the prompt as soon as the check is done, bash shows it on the next prompt.\n" +
+		"With --no-prompt your prompt is left alone; use $__config_sync_segment (bash, zsh) or\n" +
+		"config_sync_segment (fish) in it yourself.",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: promptShells,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		noPrompt, _ := cmd.Flags().GetBool("no-prompt")
+		hook, err := ShellHook(args[0], !noPrompt)
+		if err != nil {
+			return fmt.Errorf("shell hook failed: %w", err)
+		}
+		fmt.Print(hook)
+		return nil
 	},
 }
 
+// statusOutputHelp documents --output and the exit codes of check-updates and status
+const statusOutputHelp = "--output json|porcelain|exit-code switches to machine-readable output and exits with:\n" +
+	"  0  in sync\n" +
+	"  1  error\n" +
+	"  2  needs push (changed files or unpushed commits)\n" +
+	"  3  needs pull\n" +
+	"  4  diverged (needs pull and push)"
+
+// runStatusCheck runs the checks of check-updates and status and renders the result
+// silentWhenInSync keeps check-updates quiet in shell prompts when there's nothing to do
+func runStatusCheck(cmd *cobra.Command, silentWhenInSync bool) error {
+	git := NewGitRunner()
+	output, _ := cmd.Flags().GetString("output")
+	switch output {
+	case "", "json", "porcelain", "exit-code":
+	default:
+		return usageErrorf("unknown output %q (expected json, porcelain or exit-code)", output)
+	}
+
+	// Check if git repo exists
+	if _, err := os.Stat(filepath.Join(configFolder().FullPath, ".git")); os.IsNotExist(err) {
+		if !silentWhenInSync {
+			return fmt.Errorf("%w. Run: config-sync init", errNotInitialized)
+		}
+		return nil // Silent exit if not initialized
+	}
+
+	// Background refresh of the cached remote head, started by the cached-state strategy
+	if refresh, _ := cmd.Flags().GetBool("refresh-remote"); refresh {
+		RefreshRemoteState(cmd.Context(), git, configFolder())
+		return nil
+	}
+
+	// Load config to check for unsynced source files
+	if err := appConfig.Initialize(configFolder()); err == nil {
+		timeouts, err := ResolveTimeouts(&appConfig)
+		if err != nil {
+			return fmt.Errorf("check failed: %w", err)
+		}
+		appTimeouts = timeouts
+	}
+
+	// Timings are only shown on request: --timings (text on stderr), --timings=json, or --verbose
+	timings, _ := cmd.Flags().GetString("timings")
+	// With JSON logs the timings are part of the result instead
+	if logVerbose && timings == "" && logFormat == "text" {
+		timings = "text"
+	}
+	switch timings {
+	case "", "text", "json":
+	default:
+		return usageErrorf("unknown timings format %q (expected text or json)", timings)
+	}
+	logger := NewTimingLogger("["+cmd.Name()+"] ", timings == "text")
+	if timings == "json" {
+		defer WriteTimingsJSON(os.Stderr, logger)
+	}
+
+	syncDir := filepath.Join(configFolder().FullPath, "synced-files")
+
+	if runs, _ := cmd.Flags().GetInt("benchmark"); runs > 0 {
+		for _, result := range TimeCheckers(cmd.Context(), git, &appConfig, syncDir, runs) {
+			if result.Err != nil {
+				fmt.Printf("%-16s error: %v\n", result.Name, result.Err)
+				continue
+			}
+			fmt.Printf("%-16s %8.2fms avg over %d runs (unsynced: %t)\n",
+				result.Name, float64(result.Average.Microseconds())/1000, runs, result.Unsynced)
+		}
+		return nil
+	}
+
+	// Create the check strategy picked by the flag or the config
+	strategy, _ := cmd.Flags().GetString("strategy")
+	if strategy == "" {
+		strategy = appConfig.CheckStrategyName()
+	}
+	if repoBusy {
+		// Another run may be rewriting the synced copies, the cached state is the best answer right now
+		strategy = "cached-state"
+	}
+	checker, err := NewChecker(strategy, git, &appConfig, syncDir, logger)
+	if err != nil {
+		return fmt.Errorf("check failed: %w", err)
+	}
+
+	// Run checks
+	status, checkErr := RunSyncChecks(cmd.Context(), checker, git, logger)
+	status.Watch, _ = QueryWatchStatus(configFolder())
+	status.Busy = repoBusy
+	setResult("status", status)
+	// Other failed checks are part of the output, only the exit code reports them
+	if checkErr != nil && cmd.Context().Err() != nil {
+		return cmd.Context().Err()
+	}
+
+	switch output {
+	case "json":
+		status.WriteJSON(os.Stdout)
+	case "porcelain":
+		status.WritePorcelain(os.Stdout)
+	case "exit-code":
+	default:
+		if silentWhenInSync && status.InSync() {
+			return nil // Silent exit - everything up to date
+		}
+		for _, msg := range status.HumanLines() {
+			log.Println(msg)
+		}
+		// check-updates never breaks a prompt without --output
+		if checkErr != nil && !silentWhenInSync {
+			return silentExit(exitCode(checkErr))
+		}
+		return nil
+	}
+
+	// An incomplete answer isn't a sync state
+	if checkErr != nil {
+		return silentExit(exitCode(checkErr))
+	}
+	if code := status.ExitCode(); code != ExitInSync {
+		return silentExit(code)
+	}
+	return nil
+}
+
 func init() {
-	setOriginCmd.Flags().Bool("force", false, "Bypass public repository warning")
+	setOriginCmd.Flags().Bool("replace", false, "Replace an existing origin")
+	setOriginCmd.Flags().Bool("force", false, "Bypass public repository warning and remote validation")
 	initFromCmd.Flags().Bool("force", false, "Bypass public repository warning")
-	checkUpdatesCmd.Flags().StringP("strategy", "s", "manual", "Check strategy: manual or copy-then-diff")
+	initFromCmd.Flags().Bool("reset", false, "Replace an existing ~/.config-sync without merging its tracked paths (it's still backed up)")
+	bootstrapCmd.Flags().Bool("force", false, "Bypass public repository warning")
+	bootstrapCmd.Flags().Bool("yes", false, "Replace existing files that differ without asking (they are still backed up)")
+	bootstrapCmd.Flags().String("profile", "", "Profile this machine syncs as, saved in local.json (CONFIG_SYNC_PROFILE overrides it)")
+	bootstrapCmd.Flags().String("shell", "", "Shell to install the prompt hook for: "+strings.Join(promptShells, ", ")+", or none (default from $SHELL)")
+	pullCmd.Flags().Bool("verify-signatures", false, "Refuse to restore commits not signed by a trusted key")
+	pushCmd.Flags().StringP("message", "m", "", "Commit message (the change list and trailers are still appended)")
+	remoteAddCmd.Flags().Bool("no-push", false, "Only pull from this remote, never push to it")
+	remoteSetURLCmd.Flags().Bool("push", true, "Whether push sends commits to this remote")
+	remoteCmd.AddCommand(remoteListCmd, remoteAddCmd, remoteRemoveCmd, remoteSetURLCmd)
+	restoreCmd.Flags().String("at", "", "Commit or date (YYYY-MM-DD)")
+	restoreCmd.Flags().Int("ago", 0, "Number of pushes of the path ago, 1 is the version before the current one")
+	restoreCmd.MarkFlagsOneRequired("at", "ago")
+	restoreCmd.MarkFlagsMutuallyExclusive("at", "ago")
+	for _, cmd := range []*cobra.Command{checkUpdatesCmd, statusCmd} {
+		cmd.Flags().StringP("strategy", "s", "", "Check strategy: "+strings.Join(CheckerNames(), ", ")+" (default from config, else "+defaultChecker+")")
+		cmd.Flags().StringP("output", "o", "", "Machine-readable output: json, porcelain or exit-code")
+		cmd.Flags().Int("benchmark", 0, "Run every check strategy this many times and compare their timings")
+		cmd.Flags().String("timings", "", "Log check timings to stderr: text or json")
+		cmd.Flags().Lookup("timings").NoOptDefVal = "text"
+	}
+	for _, cmd := range []*cobra.Command{trackCmd, untrackCmd} {
+		cmd.Flags().BoolP("interactive", "i", false, "Pick the paths from a list")
+	}
+	trackCmd.Flags().Bool("allow-secrets", false, "Track paths from --interactive or --preset that look like credentials (~/.ssh, *.pem, names with token or secret)")
+	trackCmd.Flags().StringSlice("preset", nil, "Track the config of a tool: "+strings.Join(PresetNames(), ", "))
+	trackCmd.RegisterFlagCompletionFunc("preset", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return PresetNames(), cobra.ShellCompDirectiveNoFileComp
+	})
+	listCmd.Flags().Bool("json", false, "Print the entries as a JSON array")
+	listCmd.Flags().Bool("missing", false, "Only list paths that don't exist on this machine")
+	listCmd.Flags().String("profile", "", "Only list paths last pushed from this profile (CONFIG_SYNC_PROFILE or local.json)")
+	gcCmd.Flags().Bool("remove", false, "Delete the orphaned entries and commit their removal")
+	gcCmd.Flags().Bool("prune-history", false, "Drop files that are no longer synced from the git history (rewrites history, force pushes)")
+	gcCmd.Flags().Int64("min-size", defaultPruneMinSize, "Only prune files whose versions add up to at least this many bytes")
+	gcCmd.Flags().Bool("yes", false, "Don't ask before rewriting history")
+	watchCmd.Flags().Duration("debounce", DefaultWatchOptions().Debounce, "Quiet time after the last edit before pushing")
+	watchCmd.Flags().Duration("pull-interval", DefaultWatchOptions().PullInterval, "How often to pull remote changes")
+	// Commands that change the repository lock it exclusively, read-only checks share the lock
+	for _, cmd := range []*cobra.Command{trackCmd, untrackCmd, pullCmd, pushCmd, restoreCmd, setOriginCmd, remoteAddCmd, remoteRemoveCmd, remoteSetURLCmd, gcCmd} {
+		cmd.Annotations = map[string]string{"lock": LockExclusive}
+	}
+	for _, cmd := range []*cobra.Command{listCmd} {
+		cmd.Annotations = map[string]string{"lock": LockShared}
+	}
+	// Checks run from prompts never wait, a busy repository is answered from cached state
+	for _, cmd := range []*cobra.Command{checkUpdatesCmd, statusCmd} {
+		cmd.Annotations = map[string]string{"lock": LockCheck}
+	}
+	// prompt-segment and doctor take no lock: the segment only reads cached state,
+	// and doctor has to run when taking one is what's broken
+	// bootstrap locks once it has cloned, the lock file would make the folder non-empty
+	daemonInstallCmd.Flags().Duration("interval", defaultDaemonInterval, "How often to pull and push")
+	daemonInstallCmd.Flags().StringSlice("notify", nil, "Where to report conflicts: stdout, desktop or a webhook URL (saved in local.json)")
+	for _, cmd := range []*cobra.Command{daemonInstallCmd, daemonUninstallCmd, daemonStatusCmd} {
+		cmd.Flags().String("method", "auto", "Service manager: "+strings.Join(daemonMethods, ", "))
+		cmd.Flags().String("root", "", "Only write the units or crontab into this directory, don't start anything")
+	}
+	daemonRunCmd.Flags().String("log-file", "", "Append the log to this file instead of stderr")
+	daemonCmd.AddCommand(daemonInstallCmd, daemonUninstallCmd, daemonStatusCmd, daemonRunCmd)
+	promptSegmentCmd.Flags().String("shell", "", "Shell to format colors for: "+strings.Join(promptShells, ", ")+" (plain text if empty)")
+	promptSegmentCmd.Flags().Bool("no-color", false, "Print the segment without colors (also set by NO_COLOR)")
+	shellHookCmd.Flags().Bool("no-prompt", false, "Only keep the segment variable up to date, don't change the prompt")
+	rootCmd.PersistentFlags().BoolVarP(&logVerbose, "verbose", "v", false, "Show more details: git commands and their output, check timings")
+	rootCmd.PersistentFlags().BoolVarP(&logQuiet, "quiet", "q", false, "Only show warnings and errors")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format: text, or json for one JSON object per line and a final result object")
+	rootCmd.PersistentFlags().StringVar(&configHome, "home", "", "Config folder to use (default $CONFIG_SYNC_HOME, else ~/.config-sync)")
+	rootCmd.PersistentFlags().StringToStringVar(&timeoutFlags, "timeout", nil,
+		"Override timeouts, e.g. --timeout git_remote=10s,file_copy=3s ("+strings.Join(timeoutNames(), ", ")+")")
+	rootCmd.PersistentFlags().IntVar(&syncWorkers, "workers", 0, "Files to hash or copy at once (default: number of CPUs, at least 4)")
+	checkUpdatesCmd.Flags().Bool("refresh-remote", false, "Update the cached remote head and exit")
+	checkUpdatesCmd.Flags().MarkHidden("refresh-remote")
+
+	rootCmd.AddCommand(initCmd, initFromCmd, bootstrapCmd, checkUpdatesCmd, statusCmd, trackCmd, untrackCmd, pullCmd, pushCmd, restoreCmd, setOriginCmd, remoteCmd, watchCmd, daemonCmd, promptSegmentCmd, shellHookCmd, doctorCmd, gcCmd, listCmd)
+	// Argument errors come before PersistentPreRunE, they should already follow --log-format
+	cobra.OnInitialize(func() {
+		if setupLogging() == nil && logFormat == "json" {
+			rootCmd.SilenceUsage = true
+		}
+	})
 }
 
 var rootCmd = &cobra.Command{
@@ -259,36 +1068,121 @@ var rootCmd = &cobra.Command{
 	Short: "Sync config files across machines",
 	Long: `config-sync helps you track and sync configuration files across machines.
 Files are stored in ~/.config-sync/synced-files and can be managed with git.
+Use --home or CONFIG_SYNC_HOME to keep separate repositories, e.g. personal dotfiles
+and team editor settings, each with its own tracked files and remotes.
+
+` + exitCodesHelp + `
 
 Version: ` + Version,
 	Version: Version,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		// Skip initialization check for init, init-from, check-updates, help, completion, and version commands
+		// Skip initialization check for init, init-from, bootstrap, the prompt helpers, doctor, help, completion, and version commands
 		skipInitCheck := map[string]bool{
-			"init":          true,
-			"init-from":     true,
-			"check-updates": true,
-			"help":          true,
-			"completion":    true,
-			"version":       true,
+			"init":           true,
+			"init-from":      true,
+			"bootstrap":      true,
+			"check-updates":  true,
+			"prompt-segment": true,
+			"shell-hook":     true,
+			"doctor":         true,
+			"help":           true,
+			"completion":     true,
+			"version":        true,
+		}
+		// Cobra only checks required flags and flag groups (restore's --at/--ago) after this hook
+		if err := cmd.ValidateRequiredFlags(); err != nil {
+			return err
+		}
+		if err := cmd.ValidateFlagGroups(); err != nil {
+			return err
+		}
+		lockMode := cmd.Annotations["lock"]
+		// Past argument parsing, failures here aren't usage mistakes
+		cmd.SilenceUsage = true
+		resultCommand = cmd.CommandPath()
+		if err := setupLogging(); err != nil {
+			return &usageError{err}
 		}
 		if skipInitCheck[cmd.Name()] {
-			return nil
+			// Env and flag timeouts still apply, config.json ones once the command loads it
+			var err error
+			if appTimeouts, err = ResolveTimeouts(nil); err != nil {
+				return err
+			}
+			return lockForCommand(lockMode)
 		}
 
 		// Try to load existing config
 		err := appConfig.Initialize(configFolder())
 		if err != nil {
 			if os.IsNotExist(err) || !appConfig.IsInitialized() {
-				return fmt.Errorf("config not initialized. Run one of:\n  config-sync init              # Start fresh\n  config-sync init-from <url>   # Clone existing repo")
+				return fmt.Errorf("%w. Run one of:\n  config-sync init              # Start fresh\n  config-sync init-from <url>   # Clone existing repo", errNotInitialized)
 			}
 			return err
 		}
+
+		if appTimeouts, err = ResolveTimeouts(&appConfig); err != nil {
+			return err
+		}
+		if err := lockForCommand(lockMode); err != nil {
+			return err
+		}
+		if lockMode == LockExclusive {
+			// Another run may have changed config.json while we waited for the lock
+			return appConfig.Reload()
+		}
 		return nil
 	},
+	// execute logs errors itself, so they follow --log-format
+	SilenceErrors: true,
+}
+
+// execute runs the command line in args and renders its outcome, returning the exit code
+func execute(ctx context.Context, args []string) int {
+	rootCmd.SetArgs(args)
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	commandLock.Release()
+	commandLock = nil
+	if err == nil {
+		finishCommand(0, nil)
+		return 0
+	}
+
+	// A bad --log-format itself falls back to text
+	if setupLogging() != nil {
+		logFormat = "text"
+	}
+	// Errors before PersistentPreRunE come from parsing the arguments and flags
+	if resultCommand == "" {
+		resultCommand = cmd.CommandPath()
+		err = &usageError{err}
+	}
+	code := exitCode(err)
+	if ctx.Err() != nil {
+		// A git command killed by Ctrl-C fails with its own error
+		code = ExitInterrupted
+	}
+	var silent silentExit
+	if errors.As(err, &silent) {
+		finishCommand(code, nil)
+		return code
+	}
+	logAt(levelError, "Error: %v", err)
+	finishCommand(code, err)
+	return code
 }
 
 func main() {
-	rootCmd.AddCommand(initCmd, initFromCmd, checkUpdatesCmd, trackCmd, untrackCmd, pullCmd, pushCmd, setOriginCmd)
-	rootCmd.Execute()
+	// Ctrl-C cancels the running command, which stops and rolls back what it was doing
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// A second Ctrl-C kills right away instead of waiting for the cleanup
+		stop()
+	}()
+
+	code := execute(ctx, os.Args[1:])
+	stop()
+	os.Exit(code)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Notifier tells the user about events that need their attention, like merge conflicts
+type Notifier interface {
+	Notify(title, message string) error
+}
+
+// conflictTitle is the title of merge conflict notifications
+const conflictTitle = "config-sync: merge conflict"
+
+// conflictMessage tells the user what to do about a merge conflict
+func conflictMessage() string {
+	return "Syncing is paused until the conflict in " + configFolder().TildePath + " is resolved and committed"
+}
+
+// notifierKinds lists the accepted notify settings, besides webhook URLs
+var notifierKinds = []string{"stdout", "desktop"}
+
+// NewNotifier creates a notifier from a notify setting: stdout, desktop, or an http(s) URL for a webhook
+func NewNotifier(spec string) (Notifier, error) {
+	switch {
+	case spec == "stdout":
+		return stdoutNotifier{}, nil
+	case spec == "desktop":
+		return desktopNotifier{}, nil
+	case strings.HasPrefix(spec, "https://") || strings.HasPrefix(spec, "http://"):
+		return webhookNotifier{url: spec}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q (available: %s, or a webhook URL)", spec, strings.Join(notifierKinds, ", "))
+	}
+}
+
+// LoadNotifier builds the notifiers listed under "notify" in local.json, stdout if none are
+func LoadNotifier(folder ShorthandPath) (Notifier, error) {
+	settings, err := LoadLocalSettings(folder)
+	if err != nil {
+		return nil, err
+	}
+	specs := settings.Notify
+	if len(specs) == 0 {
+		specs = []string{"stdout"}
+	}
+
+	var notifiers multiNotifier
+	for _, spec := range specs {
+		notifier, err := NewNotifier(spec)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+// multiNotifier sends every notification to all its notifiers
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(title, message string) error {
+	var errs []error
+	for _, notifier := range m {
+		errs = append(errs, notifier.Notify(title, message))
+	}
+	return errors.Join(errs...)
+}
+
+// stdoutNotifier writes notifications to the log, which is the log file when run by the daemon
+type stdoutNotifier struct{}
+
+func (stdoutNotifier) Notify(title, message string) error {
+	log.Printf("%s: %s\n", title, message)
+	return nil
+}
+
+// desktopNotifier shows a desktop notification with notify-send, or osascript on macOS
+type desktopNotifier struct{}
+
+func (desktopNotifier) Notify(title, message string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		script := fmt.Sprintf("display notification %q with title %q", message, title)
+		cmd = exec.Command("osascript", "-e", script)
+	} else {
+		cmd = exec.Command("notify-send", "--app-name=config-sync", title, message)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("desktop notification failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// webhookNotifier posts notifications as JSON: {"title", "message", "host"}
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Notify(title, message string) error {
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]string{"title": title, "message": message, "host": host})
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook failed: %s", resp.Status)
+	}
+	return nil
+}
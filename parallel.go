@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// syncWorkers bounds how many files are hashed or copied at once, 0 picks a default
+// Set with --workers, mostly to compare timings against --workers 1
+var syncWorkers int
+
+// workerCount returns the worker pool size in effect
+// Hashing and copying wait on the disk as much as on the CPU, so there are at least 4 workers
+func workerCount() int {
+	if syncWorkers > 0 {
+		return syncWorkers
+	}
+	return max(runtime.NumCPU(), 4)
+}
+
+// forEachParallel calls fn for every index below n on a pool of workers
+// The first failure stops handing out further indexes and cancels ctx for the calls still running.
+// When several calls fail, the error of the lowest index is returned, so it doesn't depend on scheduling
+func forEachParallel(parent context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	errs := make([]error, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workerCount(), n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(ctx, i); err != nil {
+					errs[i] = err
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range n {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return parent.Err()
+}
+
+// copyChunkSize is how much copyChunks copies between checks of the context and the stall watchdog
+const copyChunkSize = 1 << 20
+
+// copyChunks copies src into dst a chunk at a time, so a big copy stops when another one failed
+// Each chunk still goes through dst.ReadFrom, which lets the kernel copy between files without a buffer
+func copyChunks(ctx context.Context, dst, src *os.File, watchdog *stallWatchdog) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: copyChunkSize})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		watchdog.progress()
+	}
+}
+
+// fileCopy is a single file to copy
+type fileCopy struct {
+	src, dst string
+}
+
+// planDirCopy creates dst and every directory below it like in src, and lists the files to copy
+// Directories are created up front, so the files can then be copied in any order
+func planDirCopy(src, dst string) ([]fileCopy, error) {
+	var copies []fileCopy
+	err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if !d.IsDir() {
+			copies = append(copies, fileCopy{src: path, dst: target})
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.MkdirAll(target, info.Mode())
+	})
+	return copies, err
+}
+
+// copyFiles copies files on the worker pool
+func copyFiles(ctx context.Context, copies []fileCopy) error {
+	return forEachParallel(ctx, len(copies), func(ctx context.Context, i int) error {
+		return copyFile(ctx, copies[i].src, copies[i].dst)
+	})
+}
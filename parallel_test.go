@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchmarkFiles is the size of the generated tree, about what a large editor or shell setup tracks
+const benchmarkFiles = 10000
+
+// writeTree creates files below dir, 100 per subfolder with a few hundred bytes each,
+// and returns their paths
+func writeTree(tb testing.TB, dir string, files int) []string {
+	tb.Helper()
+	paths := make([]string, 0, files)
+	line := strings.Repeat("set option value\n", 20)
+	for i := range files {
+		path := filepath.Join(dir, fmt.Sprintf("dir%03d", i/100), fmt.Sprintf("file%03d.conf", i%100))
+		if i%100 == 0 {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("# %d\n%s", i, line)), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestCopyFiles(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, 250)
+	dst := filepath.Join(t.TempDir(), "copy")
+
+	copies, err := planDirCopy(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copies) != 250 {
+		t.Fatalf("planned %d copies, want 250", len(copies))
+	}
+	if err := copyFiles(context.Background(), copies); err != nil {
+		t.Fatal(err)
+	}
+
+	srcHashes, errs := hashPaths(context.Background(), []string{src, dst}, fileHash)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if srcHashes[0] != srcHashes[1] {
+		t.Errorf("copy hashes to %s, source to %s", srcHashes[1], srcHashes[0])
+	}
+}
+
+func TestCopyChunksStall(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	dst, err := os.Create(filepath.Join(t.TempDir(), "copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Some data arrives, then the writer hangs without closing
+	writer.Write([]byte("export EDITOR=vim\n"))
+	watchdog := watchStall(reader, 100*time.Millisecond)
+	err = watchdog.Stop(copyChunks(context.Background(), dst, reader, watchdog))
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Errorf("copy from a hung pipe returned %v, want a stall", err)
+	}
+}
+
+func TestHashPathsReportsEachError(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeTree(t, dir, 3)
+	missing := filepath.Join(dir, "missing")
+
+	hashes, errs := hashPaths(context.Background(), append(paths, missing), fileHash)
+	for i := range paths {
+		if errs[i] != nil || hashes[i] == "" {
+			t.Errorf("%s: hash %q, error %v", paths[i], hashes[i], errs[i])
+		}
+	}
+	if !os.IsNotExist(errs[3]) {
+		t.Errorf("%s: error %v, want not exist", missing, errs[3])
+	}
+}
+
+func BenchmarkHashPaths(b *testing.B) {
+	dir := b.TempDir()
+	paths := writeTree(b, dir, benchmarkFiles)
+	ctx := context.Background()
+
+	// A tracked directory is hashed file by file in one pool, like many tracked files
+	for _, bench := range []struct {
+		name    string
+		targets []string
+	}{{"directory", []string{dir}}, {"files", paths}} {
+		b.Run(bench.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, errs := hashPaths(ctx, bench.targets, fileHash); errs[0] != nil {
+					b.Fatal(errs[0])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSyncFiles(b *testing.B) {
+	env := newTestEnv(b)
+	env.mustRun("init")
+	writeTree(b, filepath.Join(env.home, ".config", "bench"), benchmarkFiles)
+	env.mustRun("track", "~/.config/bench")
+
+	resetCommandState()
+	var config JsonConfig
+	if err := config.Initialize(ShorthandPath{}.New(env.folder)); err != nil {
+		b.Fatal(err)
+	}
+	setLogSink(io.Discard)
+	defer setLogSink(os.Stderr)
+
+	ctx := context.Background()
+	for b.Loop() {
+		if err := config.SyncFiles(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Limits for paths offered by track --interactive, anything bigger is rarely configuration
+const (
+	maxCandidateFileSize = 1 << 20
+	maxCandidateDirSize  = 10 << 20
+	maxCandidateDirFiles = 1000
+)
+
+// candidateSkipped are never offered: caches, shell history and tool state rather than configuration
+var candidateSkipped = map[string]bool{
+	".cache": true, ".local": true, ".npm": true, ".cargo": true, ".rustup": true, ".gradle": true,
+	".m2": true, ".Trash": true, ".vscode-server": true, ".config-sync": true, ".lesshst": true,
+	".viminfo": true, ".wget-hsts": true, ".DS_Store": true, ".sudo_as_admin_successful": true,
+}
+
+// candidateSecrets hold credentials and are never offered, even if they look like configuration
+var candidateSecrets = map[string]bool{
+	".ssh": true, ".gnupg": true, ".aws": true, ".azure": true, ".kube": true, ".docker": true,
+	".netrc": true, ".pgpass": true, ".git-credentials": true, ".password-store": true, ".npmrc": true,
+	".pypirc": true, ".vault-token": true, ".env": true, "gh": true, "gcloud": true, "op": true,
+}
+
+// secretExtensions mark key and keystore files
+var secretExtensions = []string{".pem", ".key", ".p12", ".pfx", ".kdbx", ".gpg", ".asc"}
+
+// skipCandidate reports whether a name in ~ or ~/.config is a cache, history or secret
+func skipCandidate(name string) bool {
+	lower := strings.ToLower(name)
+	switch {
+	case candidateSkipped[name]:
+		return true
+	case strings.Contains(lower, "cache"), strings.Contains(lower, "history"), strings.HasPrefix(lower, ".zcompdump"):
+		return true
+	}
+	return secretName(name)
+}
+
+// secretName reports whether a file or folder name is a known credential store or key
+func secretName(name string) bool {
+	lower := strings.ToLower(name)
+	switch {
+	case candidateSecrets[name]:
+		return true
+	case strings.HasPrefix(lower, "id_"), strings.Contains(lower, "secret"), strings.Contains(lower, "token"), strings.Contains(lower, "credential"):
+		return true
+	}
+	return slices.Contains(secretExtensions, filepath.Ext(lower))
+}
+
+// secretPath reports whether a part of a path is a known credential store or key, e.g. ~/.ssh/config
+// Only the part below ~ counts for paths in ~, so a user named "op" can still track files
+func secretPath(path string) bool {
+	full := expandFromTilde(path)
+	if relative, err := filepath.Rel(expandFromTilde("~"), full); err == nil && !strings.HasPrefix(relative, "..") {
+		full = relative
+	}
+	return slices.ContainsFunc(strings.Split(filepath.ToSlash(full), "/"), secretName)
+}
+
+// Candidate is a path offered by the interactive picker
+type Candidate struct {
+	TildePath string
+	IsDir     bool
+	Size      int64
+	Files     int
+}
+
+// Label shows the path with its size, so big picks stand out
+func (c Candidate) Label() string {
+	if c.IsDir {
+		return fmt.Sprintf("%s/ (%d %s, %s)", c.TildePath, c.Files, plural(c.Files, "file", "files"), formatSize(c.Size))
+	}
+	return fmt.Sprintf("%s (%s)", c.TildePath, formatSize(c.Size))
+}
+
+// errTooLarge stops measuring a directory as soon as it's over the limits
+var errTooLarge = errors.New("too large")
+
+// TrackCandidates lists the dotfiles in ~ and the entries of ~/.config that could be tracked
+// Tracked paths, caches, history, known secrets and anything over the size limits are left out
+func TrackCandidates(ctx context.Context, config *JsonConfig) ([]Candidate, error) {
+	home := ShorthandPath{}.New("~/")
+	roots := []struct {
+		dir      ShorthandPath
+		dotfiles bool // Only offer names starting with a dot
+	}{
+		{home, true},
+		{home.Suffix(".config"), false},
+	}
+
+	var candidates []Candidate
+	for _, root := range roots {
+		entries, err := os.ReadDir(root.dir.FullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			name := entry.Name()
+			if root.dotfiles && (!strings.HasPrefix(name, ".") || name == ".config") {
+				continue
+			}
+			if skipCandidate(name) {
+				continue
+			}
+			path := root.dir.Suffix(name)
+			// A config folder set with --home can have any name
+			if path.FullPath == config.folder.FullPath {
+				continue
+			}
+			if _, tracked := config.Files[path.TildePath]; tracked {
+				continue
+			}
+			if candidate, ok := measureCandidate(path); ok {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// measureCandidate sizes a path, ok is false if it's over the limits or can't be read
+func measureCandidate(path ShorthandPath) (Candidate, bool) {
+	info, err := os.Stat(path.FullPath)
+	if err != nil {
+		return Candidate{}, false
+	}
+	candidate := Candidate{TildePath: path.TildePath, IsDir: info.IsDir()}
+	if !info.IsDir() {
+		candidate.Size = info.Size()
+		return candidate, info.Mode().IsRegular() && info.Size() <= maxCandidateFileSize
+	}
+
+	err = filepath.WalkDir(path.FullPath, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		candidate.Files++
+		candidate.Size += info.Size()
+		if candidate.Files > maxCandidateDirFiles || candidate.Size > maxCandidateDirSize {
+			return errTooLarge
+		}
+		return nil
+	})
+	return candidate, err == nil && candidate.Files > 0
+}
+
+// fuzzyMatch reports whether the characters of pattern appear in s in order, ignoring case
+func fuzzyMatch(pattern, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(string(r)):]
+	}
+	return true
+}
+
+// errPickCancelled is returned when the picker is left with q
+var errPickCancelled = errors.New("cancelled")
+
+// pickerHelp explains the picker input, it's line based so it also works without a terminal
+const pickerHelp = "Numbers or ranges (1 3 5-7) toggle, * toggles all shown, /text filters (fuzzy), / clears the filter,\n" +
+	"an empty line finishes, q cancels."
+
+// Pick lets the user select labels from a numbered list, reading commands line by line from in
+// Returns the indexes of the selected labels in their original order
+func Pick(in io.Reader, out io.Writer, labels []string) ([]int, error) {
+	selected := make([]bool, len(labels))
+	filter := ""
+	scanner := bufio.NewScanner(in)
+
+	for {
+		var shown []int
+		for i, label := range labels {
+			if fuzzyMatch(filter, label) {
+				shown = append(shown, i)
+			}
+		}
+
+		fmt.Fprintln(out)
+		for n, i := range shown {
+			mark := " "
+			if selected[i] {
+				mark = "x"
+			}
+			fmt.Fprintf(out, "%3d [%s] %s\n", n+1, mark, labels[i])
+		}
+		count := 0
+		for _, s := range selected {
+			if s {
+				count++
+			}
+		}
+		if filter != "" {
+			fmt.Fprintf(out, "Filter: %s (%d of %d shown)\n", filter, len(shown), len(labels))
+		}
+		fmt.Fprintf(out, "%d selected. %s\n> ", count, pickerHelp)
+
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			// End of input finishes like an empty line, so piped answers work
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			return selectedIndexes(selected), nil
+		case line == "q":
+			return nil, errPickCancelled
+		case line == "*":
+			all := !slices.ContainsFunc(shown, func(i int) bool { return !selected[i] })
+			for _, i := range shown {
+				selected[i] = !all
+			}
+		case strings.HasPrefix(line, "/"):
+			filter = strings.TrimSpace(line[1:])
+		default:
+			numbers, err := parseSelection(line, len(shown))
+			if err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			for _, n := range numbers {
+				selected[shown[n-1]] = !selected[shown[n-1]]
+			}
+		}
+	}
+	return selectedIndexes(selected), nil
+}
+
+// parseSelection parses "1 3 5-7" (commas work too) into 1-based numbers up to limit
+func parseSelection(line string, limit int) ([]int, error) {
+	var numbers []int
+	for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		from, to, isRange := strings.Cut(field, "-")
+		first, err := strconv.Atoi(from)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(to)
+		}
+		if err != nil || first < 1 || last > limit || first > last {
+			return nil, fmt.Errorf("%q is not a number or range between 1 and %d, use /%s to filter", field, limit, field)
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers, nil
+}
+
+func selectedIndexes(selected []bool) []int {
+	var indexes []int
+	for i, s := range selected {
+		if s {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// readPaths reads newline separated paths, skipping blank lines and # comments
+func readPaths(in io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
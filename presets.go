@@ -0,0 +1,170 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// presetFiles holds one JSON file per preset, add a file to presets/ to add a preset
+//
+//go:embed presets/*.json
+var presetFiles embed.FS
+
+// Preset describes where a tool keeps its configuration
+type Preset struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Paths       map[string][]string `json:"paths"`    // Tilde paths by GOOS, "all" applies everywhere
+	Ignore      []string            `json:"ignore"`   // Name patterns left out of preset directories
+	Secrets     []PresetNote        `json:"secrets"`  // Paths that are never tracked
+	Warnings    []PresetNote        `json:"warnings"` // Paths that are tracked but should be checked first
+}
+
+// PresetNote explains why a path of a preset is special
+type PresetNote struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// LoadPresets reads the embedded presets, keyed by name
+func LoadPresets() (map[string]Preset, error) {
+	files, err := presetFiles.ReadDir("presets")
+	if err != nil {
+		return nil, err
+	}
+	presets := make(map[string]Preset)
+	for _, file := range files {
+		content, err := presetFiles.ReadFile(path.Join("presets", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var preset Preset
+		if err := json.Unmarshal(content, &preset); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", file.Name(), err)
+		}
+		presets[preset.Name] = preset
+	}
+	return presets, nil
+}
+
+// PresetNames returns the embedded preset names in sorted order
+func PresetNames() []string {
+	presets, _ := LoadPresets()
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// PresetPlan is what a preset tracks on this machine
+type PresetPlan struct {
+	Paths    []string // Tilde paths to track
+	Skipped  []string // Secrets that were left out, with the reason
+	Warnings []string // Tracked paths to check before pushing, with the reason
+}
+
+// Plan resolves the preset for an OS against what exists on this machine
+// Directories are tracked whole, unless one of their entries matches an ignore pattern or a secret;
+// then their entries are tracked one by one, without the ignored ones
+func (p Preset) Plan(goos string) (PresetPlan, error) {
+	var plan PresetPlan
+	for _, tildePath := range append(slices.Clone(p.Paths["all"]), p.Paths[goos]...) {
+		full := ShorthandPath{}.New(tildePath)
+		info, err := os.Stat(full.FullPath)
+		if err != nil {
+			continue
+		}
+		if p.skipSecret(full.TildePath, &plan) {
+			continue
+		}
+		if !info.IsDir() {
+			plan.Paths = append(plan.Paths, full.TildePath)
+			continue
+		}
+
+		entries, err := os.ReadDir(full.FullPath)
+		if err != nil {
+			return plan, err
+		}
+		if !slices.ContainsFunc(entries, func(e os.DirEntry) bool { return p.excluded(full.Suffix(e.Name()).TildePath) }) {
+			plan.Paths = append(plan.Paths, full.TildePath)
+			continue
+		}
+		for _, entry := range entries {
+			child := full.Suffix(entry.Name()).TildePath
+			if p.ignored(entry.Name()) || p.skipSecret(child, &plan) {
+				continue
+			}
+			plan.Paths = append(plan.Paths, child)
+		}
+	}
+
+	for _, warning := range p.Warnings {
+		if slices.Contains(plan.Paths, warning.Path) || slices.ContainsFunc(plan.Paths, func(tracked string) bool {
+			return strings.HasPrefix(warning.Path, tracked+"/")
+		}) {
+			plan.Warnings = append(plan.Warnings, warning.Path+": "+warning.Message)
+		}
+	}
+	return plan, nil
+}
+
+// excluded reports whether a directory entry is ignored or a secret
+func (p Preset) excluded(tildePath string) bool {
+	return p.ignored(filepath.Base(tildePath)) || slices.ContainsFunc(p.Secrets, func(s PresetNote) bool { return s.Path == tildePath })
+}
+
+// ignored reports whether a name matches one of the ignore patterns
+func (p Preset) ignored(name string) bool {
+	return slices.ContainsFunc(p.Ignore, func(pattern string) bool {
+		matched, _ := filepath.Match(pattern, name)
+		return matched
+	})
+}
+
+// skipSecret records and reports a path that is one of the preset's secrets
+func (p Preset) skipSecret(tildePath string, plan *PresetPlan) bool {
+	for _, secret := range p.Secrets {
+		if secret.Path == tildePath {
+			plan.Skipped = append(plan.Skipped, secret.Path+": "+secret.Message)
+			return true
+		}
+	}
+	return false
+}
+
+// PlanPresets resolves the named presets for this machine
+func PlanPresets(names []string) (PresetPlan, error) {
+	var combined PresetPlan
+	presets, err := LoadPresets()
+	if err != nil {
+		return combined, err
+	}
+	for _, name := range names {
+		preset, ok := presets[name]
+		if !ok {
+			return combined, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(PresetNames(), ", "))
+		}
+		plan, err := preset.Plan(runtime.GOOS)
+		if err != nil {
+			return combined, err
+		}
+		if len(plan.Paths) == 0 {
+			log.Printf("Preset %s: nothing found on this machine\n", name)
+		}
+		combined.Paths = append(combined.Paths, plan.Paths...)
+		combined.Skipped = append(combined.Skipped, plan.Skipped...)
+		combined.Warnings = append(combined.Warnings, plan.Warnings...)
+	}
+	return combined, nil
+}
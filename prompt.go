@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Prompt glyphs, kept to one cell each so prompts don't jump around
+const (
+	glyphAhead  = "⇡"
+	glyphBehind = "⇣"
+	glyphDirty  = "✎"
+)
+
+// promptShells are the shells prompt-segment and shell-hook support
+var promptShells = []string{"bash", "zsh", "fish"}
+
+// PromptStatus is the compact sync state shown in shell prompts
+type PromptStatus struct {
+	Ahead  int  // Local commits not pushed
+	Behind int  // Remote commits not pulled, -1 when there are some but they aren't fetched yet
+	Dirty  bool // Tracked files changed or synced copies not committed
+}
+
+// ReadPromptStatus builds the prompt status from cached state only, it never talks to the remote
+// A stale remote head is refreshed in the background like the cached-state strategy does
+func ReadPromptStatus(ctx context.Context, config *JsonConfig, syncDir string) PromptStatus {
+	var status PromptStatus
+	checker := &CachedStateChecker{NewCheckStrategy(NewGitRunner(), config, syncDir, NewTimingLogger("", false))}
+
+	files, _ := checker.CheckUnsyncedFiles(ctx)
+	uncommitted, _ := checker.gitOutput(ctx, "status", "--porcelain")
+	status.Dirty = anyUnsynced(files) || uncommitted != ""
+
+	// No upstream yet means nothing was pushed, there's nothing to count against
+	status.Ahead, _ = checker.countCommits(ctx, "@{u}..HEAD")
+
+	state := LoadRemoteState(config.folder)
+	if !state.Fresh(checker.timeouts.RemoteTTL) {
+		refreshRemoteStateInBackground(config.folder, state, checker.timeouts.GitRemote)
+	}
+	if state.Head != "" {
+		if _, err := checker.gitOutput(ctx, "cat-file", "-e", state.Head+"^{commit}"); err != nil {
+			status.Behind = -1
+		} else {
+			status.Behind, _ = checker.countCommits(ctx, "HEAD.."+state.Head)
+		}
+	}
+	return status
+}
+
+// gitOutput runs a local git command in the sync dir within the local timeout
+func (c *CheckStrategy) gitOutput(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := timeoutContext(ctx, c.timeouts.GitLocal)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = c.syncDir
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// countCommits counts the commits in a revision range
+func (c *CheckStrategy) countCommits(ctx context.Context, revRange string) (int, error) {
+	output, err := c.gitOutput(ctx, "rev-list", "--count", revRange)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(output)
+}
+
+// String renders the status as glyphs, e.g. "⇡2 ⇣1 ✎", or "" when in sync
+func (p PromptStatus) String() string {
+	var parts []string
+	if p.Ahead > 0 {
+		parts = append(parts, glyphAhead+strconv.Itoa(p.Ahead))
+	}
+	if p.Behind > 0 {
+		parts = append(parts, glyphBehind+strconv.Itoa(p.Behind))
+	} else if p.Behind < 0 {
+		parts = append(parts, glyphBehind)
+	}
+	if p.Dirty {
+		parts = append(parts, glyphDirty)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Segment renders the status for a shell prompt
+// Colors are wrapped in the shell's zero-width markers so line editing keeps the right cursor position
+func (p PromptStatus) Segment(shell string, color bool) string {
+	text := p.String()
+	if text == "" || !color {
+		return text
+	}
+
+	switch shell {
+	case "bash":
+		// \001 and \002 tell readline the escapes take no space, \[ \] doesn't work in expansions
+		return "\001\033[33m\002" + text + "\001\033[0m\002"
+	case "zsh":
+		return "%F{yellow}" + text + "%f"
+	case "fish":
+		return "\033[33m" + text + "\033[0m"
+	default:
+		return text
+	}
+}
+
+// ShellHook returns the snippet that keeps the prompt segment up to date in a shell
+// The check always runs in the background, so a slow disk or network never delays the prompt
+// Unless withPrompt is false, the segment is also put in front of the existing prompt
+func ShellHook(shell string, withPrompt bool) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = "config-sync"
+	}
+
+	var hook, prompt string
+	switch shell {
+	case "bash":
+		hook, prompt = bashHook, bashPrompt
+	case "zsh":
+		hook, prompt = zshHook, zshPrompt
+	case "fish":
+		hook, prompt = fishHook, fishPrompt
+	default:
+		return "", fmt.Errorf("unsupported shell %q (supported: %s)", shell, strings.Join(promptShells, ", "))
+	}
+	if withPrompt {
+		hook += prompt
+	}
+	command := shellQuote(executable)
+	if customConfigFolder() {
+		command += " --home " + shellQuote(configFolder().FullPath)
+	}
+	return strings.ReplaceAll(hook, "@CONFIG_SYNC@", command), nil
+}
+
+// shellStartupFiles are the files InstallShellHook adds the hook to
+var shellStartupFiles = map[string]string{
+	"bash": "~/.bashrc",
+	"zsh":  "~/.zshrc",
+	"fish": "~/.config/fish/config.fish",
+}
+
+// InstallShellHook adds the line that loads the shell hook to the shell's startup file
+// Nothing is written when the file already loads a hook, the prompt shows the status of one config folder.
+// added reports whether the line was added. The line uses config-sync from PATH when it's there,
+// the startup file may itself be synced to other machines
+func InstallShellHook(shell string) (startupFile ShorthandPath, added bool, err error) {
+	tildePath, ok := shellStartupFiles[shell]
+	if !ok {
+		return startupFile, false, fmt.Errorf("unsupported shell %q (supported: %s)", shell, strings.Join(promptShells, ", "))
+	}
+	startupFile = ShorthandPath{}.New(tildePath)
+
+	content, err := os.ReadFile(startupFile.FullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return startupFile, false, err
+	}
+	if strings.Contains(string(content), " shell-hook "+shell) {
+		return startupFile, false, nil
+	}
+
+	command := "config-sync"
+	if _, err := exec.LookPath("config-sync"); err != nil {
+		if executable, err := os.Executable(); err == nil {
+			command = shellQuote(executable)
+		}
+	}
+	if customConfigFolder() {
+		command += " --home " + shellQuote(configFolder().TildePath)
+	}
+	line := fmt.Sprintf(`eval "$(%s shell-hook %s)"`, command, shell)
+	if shell == "fish" {
+		line = fmt.Sprintf("%s shell-hook fish | source", command)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(startupFile.FullPath), 0755); err != nil {
+		return startupFile, false, err
+	}
+	file, err := os.OpenFile(startupFile.FullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return startupFile, false, err
+	}
+	defer file.Close()
+	// Keep a blank line between the existing content and the hook
+	prefix := ""
+	if len(content) > 0 {
+		prefix = "\n"
+		if !strings.HasSuffix(string(content), "\n") {
+			prefix = "\n\n"
+		}
+	}
+	if _, err := fmt.Fprintf(file, "%s# config-sync prompt status\n%s\n", prefix, line); err != nil {
+		return startupFile, false, err
+	}
+	return startupFile, true, file.Close()
+}
+
+// shellQuote single-quotes a string for bash, zsh and fish
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// bashHook refreshes a file shared by all shells of the user and reads it on the next prompt
+// Bash can't redraw a prompt that's already shown, so new state appears one prompt later
+const bashHook = `# config-sync prompt integration, add to ~/.bashrc:
+#   eval "$(config-sync shell-hook bash)"
+__config_sync_segment=""
+__config_sync_file="${TMPDIR:-/tmp}/config-sync-prompt-${UID}"
+__config_sync_prompt() {
+    [[ -r $__config_sync_file ]] && __config_sync_segment="$(<"$__config_sync_file")"
+    # Double subshell detaches the check without job control messages
+    ( (tmp="$__config_sync_file.$BASHPID"
+        @CONFIG_SYNC@ prompt-segment --shell bash >"$tmp" 2>/dev/null && mv -f "$tmp" "$__config_sync_file") & )
+}
+if [[ ";${PROMPT_COMMAND};" != *";__config_sync_prompt;"* ]]; then
+    PROMPT_COMMAND="__config_sync_prompt${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+fi
+`
+
+const bashPrompt = `if [[ $PS1 != *__config_sync_segment* ]]; then
+    PS1='${__config_sync_segment:+$__config_sync_segment }'"$PS1"
+fi
+`
+
+// zshHook reads the check's output through zle -F and redraws the prompt as soon as it's done
+const zshHook = `# config-sync prompt integration, add to ~/.zshrc:
+#   eval "$(config-sync shell-hook zsh)"
+typeset -g __config_sync_segment=""
+typeset -g __config_sync_fd=""
+__config_sync_done() {
+    local fd=$1
+    IFS= read -r -u $fd __config_sync_segment
+    zle -F $fd
+    exec {fd}<&-
+    __config_sync_fd=""
+    zle && zle reset-prompt
+}
+__config_sync_precmd() {
+    if [[ -n $__config_sync_fd ]]; then
+        zle -F $__config_sync_fd 2>/dev/null
+        exec {__config_sync_fd}<&-
+    fi
+    exec {__config_sync_fd}< <(@CONFIG_SYNC@ prompt-segment --shell zsh 2>/dev/null)
+    zle -F $__config_sync_fd __config_sync_done
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd __config_sync_precmd
+setopt prompt_subst
+`
+
+const zshPrompt = `if [[ $PROMPT != *__config_sync_segment* ]]; then
+    PROMPT='${__config_sync_segment:+$__config_sync_segment }'"$PROMPT"
+fi
+`
+
+// fishHook sets a universal variable per shell from a background job and repaints when it changes
+const fishHook = `# config-sync prompt integration, add to ~/.config/fish/config.fish:
+#   config-sync shell-hook fish | source
+set -g __config_sync_var __config_sync_segment_$fish_pid
+set -g __config_sync_shown ""
+function __config_sync_prompt --on-event fish_prompt
+    command fish --no-config -c "set -U $__config_sync_var (@CONFIG_SYNC@ prompt-segment --shell fish 2>/dev/null)" &
+    disown $last_pid 2>/dev/null
+end
+function __config_sync_repaint --on-variable $__config_sync_var
+    # Only repaint on change, a repaint fires fish_prompt and starts another check
+    if test "$$__config_sync_var" != "$__config_sync_shown"
+        set -g __config_sync_shown "$$__config_sync_var"
+        commandline -f repaint
+    end
+end
+function __config_sync_cleanup --on-event fish_exit
+    set -eU $__config_sync_var
+end
+function config_sync_segment --description 'Print the config-sync prompt segment'
+    set -q $__config_sync_var; and echo -n $$__config_sync_var
+end
+`
+
+const fishPrompt = `if not functions -q __config_sync_original_prompt
+    functions -c fish_prompt __config_sync_original_prompt
+    function fish_prompt
+        set -l segment (config_sync_segment)
+        test -n "$segment"; and echo -n "$segment "
+        __config_sync_original_prompt
+    end
+end
+`
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// primaryRemote is the remote pulled from first and tracked as upstream
+const primaryRemote = "origin"
+
+// Remote is a git remote of the config repository
+// Every remote other than the primary one is a mirror
+type Remote struct {
+	Name string
+	URL  string
+	Push bool // Whether push sends commits to this remote
+}
+
+// pushSettingKey is the git config key that stores whether a remote is push-enabled
+func pushSettingKey(name string) string {
+	return "remote." + name + ".configSyncPush"
+}
+
+// Remotes lists the configured remotes, primary first then mirrors by name
+func (g RealGitRunner) Remotes(ctx context.Context) ([]Remote, error) {
+	listing, err := g.output(ctx, "remote")
+	if err != nil {
+		return nil, err
+	}
+
+	var remotes []Remote
+	for _, name := range strings.Fields(listing) {
+		url, err := g.output(ctx, "remote", "get-url", name)
+		if err != nil {
+			return nil, err
+		}
+		push := true
+		if value, err := g.output(ctx, "config", "--type=bool", "--get", pushSettingKey(name)); err == nil {
+			push = value == "true"
+		}
+		remotes = append(remotes, Remote{Name: name, URL: url, Push: push})
+	}
+
+	sort.SliceStable(remotes, func(i, j int) bool {
+		if remotes[i].Name == primaryRemote || remotes[j].Name == primaryRemote {
+			return remotes[i].Name == primaryRemote
+		}
+		return remotes[i].Name < remotes[j].Name
+	})
+	return remotes, nil
+}
+
+// AddRemote adds a named remote, mirrors can be excluded from push
+func (g RealGitRunner) AddRemote(ctx context.Context, name, url string, push bool) error {
+	if err := g.run(ctx, "remote", "add", name, url); err != nil {
+		return fmt.Errorf("git remote add failed: %w", err)
+	}
+	return g.SetRemotePush(ctx, name, push)
+}
+
+// RemoveRemote removes a named remote and its config-sync settings
+func (g RealGitRunner) RemoveRemote(ctx context.Context, name string) error {
+	return g.run(ctx, "remote", "remove", name)
+}
+
+// SetRemoteURL changes the URL of an existing remote
+func (g RealGitRunner) SetRemoteURL(ctx context.Context, name, url string) error {
+	return g.run(ctx, "remote", "set-url", name, url)
+}
+
+// SetRemotePush enables or disables pushing to a remote
+func (g RealGitRunner) SetRemotePush(ctx context.Context, name string, push bool) error {
+	return g.run(ctx, "config", pushSettingKey(name), fmt.Sprint(push))
+}
+
+// RemoteHead returns the hash of main on a remote, or "" if the remote has no main branch yet
+// Returns an error when the remote can't be reached within the remote timeout
+func (g RealGitRunner) RemoteHead(ctx context.Context, name string) (string, error) {
+	ctx, cancel := timeoutContext(ctx, appTimeouts.GitRemote)
+	defer cancel()
+
+	cmd := gitCommand(ctx, g.dir, "ls-remote", "--heads", name, "main")
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("%s timed out", name)
+		}
+		return "", fmt.Errorf("%s is unreachable", name)
+	}
+
+	// ls-remote output format: "<hash>\trefs/heads/main"
+	hash, _, _ := strings.Cut(string(output), "\t")
+	return strings.TrimSpace(hash), nil
+}
+
+// pullOrder returns the remotes to pull from, primary first then mirrors
+func (g RealGitRunner) pullOrder(ctx context.Context) []string {
+	remotes, err := g.Remotes(ctx)
+	if err != nil || len(remotes) == 0 {
+		return []string{primaryRemote}
+	}
+	names := make([]string, 0, len(remotes))
+	for _, remote := range remotes {
+		names = append(names, remote.Name)
+	}
+	return names
+}
+
+// withFallback runs a pull-like operation against the primary remote,
+// moving on to the next mirror only when the remote that failed is unreachable
+func (g RealGitRunner) withFallback(ctx context.Context, op func(remote string) error) error {
+	remotes := g.pullOrder(ctx)
+	for i, remote := range remotes {
+		err := op(remote)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// Interrupted, not unreachable
+			return err
+		}
+		if _, reachErr := g.RemoteHead(ctx, remote); reachErr == nil {
+			// The remote is up, the failure is something a mirror won't fix
+			return err
+		}
+		if i == len(remotes)-1 {
+			return &networkError{err}
+		}
+		log.Printf("Remote %s is unreachable, falling back to %s\n", remote, remotes[i+1])
+	}
+	return nil
+}
+
+// RemoteStatus is the sync state of the local repository against one remote
+type RemoteStatus struct {
+	Name      string `json:"name"`
+	Reachable bool   `json:"reachable"`
+	InSync    bool   `json:"in_sync"` // Remote main matches local HEAD
+}
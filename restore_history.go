@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// RestoreAt restores a single tracked file or directory as it was at a commit or date
+// The synced copy is read straight from git, so the working tree and synced-files stay untouched
+func (c *JsonConfig) RestoreAt(ctx context.Context, git GitRunner, file string, at string) error {
+	path, err := c.historyPath(file)
+	if err != nil {
+		return err
+	}
+	commit, err := git.ResolveRevision(ctx, at)
+	if err != nil {
+		return err
+	}
+	return c.restoreVersion(ctx, git, path, commit)
+}
+
+// RestoreAgo restores a single tracked file or directory as it was n pushes of it ago
+// Only pushes and pulls that changed this path count. When the last of them is what's on disk,
+// counting starts before it, so 1 is the version before the current one
+func (c *JsonConfig) RestoreAgo(ctx context.Context, git GitRunner, file string, n int) error {
+	path, err := c.historyPath(file)
+	if err != nil {
+		return err
+	}
+
+	syncedPath := "synced-files/" + md5Hash(path.TildePath)
+	versions, err := git.PathVersions(ctx, syncedPath)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s has never been pushed", path.TildePath)
+	}
+	if n == 0 {
+		return c.restoreVersion(ctx, git, path, versions[0])
+	}
+
+	current, err := c.isVersion(ctx, git, path, versions[0])
+	if err != nil {
+		return err
+	}
+	if current {
+		versions = versions[1:]
+	}
+	if n > len(versions) {
+		return fmt.Errorf("%s has only %d older versions", path.TildePath, len(versions))
+	}
+	return c.restoreVersion(ctx, git, path, versions[n-1])
+}
+
+// historyPath returns the tracked path to restore from history
+func (c *JsonConfig) historyPath(file string) (ShorthandPath, error) {
+	if err := c.checkInitialized(); err != nil {
+		return ShorthandPath{}, err
+	}
+	path := ShorthandPath{}.New(file)
+	if _, exists := c.Files[path.TildePath]; !exists {
+		return ShorthandPath{}, fmt.Errorf("%s is not tracked", path.TildePath)
+	}
+	return path, nil
+}
+
+// exportVersion writes the synced copy of path in commit below a new temp dir, laid out like synced-files
+// The caller removes the returned dir
+func exportVersion(ctx context.Context, git GitRunner, path ShorthandPath, commit string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "config-sync-restore-")
+	if err != nil {
+		return "", err
+	}
+	if err := git.ExportPath(ctx, commit, "synced-files/"+md5Hash(path.TildePath), tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf("could not read %s from history: %w", path.TildePath, err)
+	}
+	return tmpDir, nil
+}
+
+// isVersion reports whether path on disk has the content it had in commit
+func (c *JsonConfig) isVersion(ctx context.Context, git GitRunner, path ShorthandPath, commit string) (bool, error) {
+	if _, err := os.Stat(path.FullPath); os.IsNotExist(err) {
+		return false, nil
+	}
+	tmpDir, err := exportVersion(ctx, git, path, commit)
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmpDir)
+	return sameContent(ctx, path.FullPath, filepath.Join(tmpDir, "synced-files", md5Hash(path.TildePath), filepath.Base(path.FullPath)))
+}
+
+// restoreVersion restores path from its synced copy in commit
+// Restoring the content that's already there is an error, so a wrong revision doesn't look like it worked
+func (c *JsonConfig) restoreVersion(ctx context.Context, git GitRunner, path ShorthandPath, commit string) error {
+	tmpDir, err := exportVersion(ctx, git, path, commit)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	syncDir := filepath.Join(tmpDir, "synced-files")
+	incoming := filepath.Join(syncDir, md5Hash(path.TildePath), filepath.Base(path.FullPath))
+	if same, err := sameContent(ctx, path.FullPath, incoming); err == nil && same {
+		return fmt.Errorf("%s already has its content from %s, nothing to restore", path.TildePath, shortHash(commit))
+	}
+
+	log.Printf("Restoring %s from %s\n", path.TildePath, shortHash(commit))
+	// The directory as it was then, without the files added since
+	return c.restoreFrom(ctx, syncDir, []string{path.TildePath}, NewBackupSession(c.folder), true)
+}
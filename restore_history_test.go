@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreAgoCountsPushesOfThePath(t *testing.T) {
+	env := newTestEnv(t)
+	env.setup()
+	zshrc := env.writeHome(".zshrc", "export EDITOR=vim\n")
+	vimrc := env.writeHome(".vimrc", "set number\n")
+	env.mustRun("track", zshrc, vimrc)
+	env.mustRun("push")
+
+	env.writeHome(".zshrc", "export EDITOR=vim\nbroken(\n")
+	env.mustRun("push")
+	// Pushes of other paths don't count
+	env.writeHome(".vimrc", "set number\nset hlsearch\n")
+	env.mustRun("push")
+
+	env.mustRun("restore", zshrc, "--ago", "1")
+	if content, _ := os.ReadFile(filepath.Join(env.home, ".zshrc")); string(content) != "export EDITOR=vim\n" {
+		t.Errorf("restore --ago 1 left ~/.zshrc as %q", content)
+	}
+
+	env.mustRun("push")
+	if code, _, logs := env.run("restore", zshrc, "--ago", "0"); code != ExitError {
+		t.Errorf("restoring the content on disk exited %d, want %d:\n%s", code, ExitError, logs)
+	}
+	if code, _, logs := env.run("restore", zshrc, "--ago", "5"); code != ExitError {
+		t.Errorf("restore beyond the history exited %d, want %d:\n%s", code, ExitError, logs)
+	}
+}
+
+func TestRestoreDirectoryFromHistory(t *testing.T) {
+	env := newTestEnv(t)
+	env.setup()
+	env.writeHome("d/a", "first\n")
+	env.mustRun("track", "~/d")
+	env.mustRun("push")
+
+	env.writeHome("d/a", "second\n")
+	env.writeHome("d/b", "added later\n")
+	env.mustRun("push")
+
+	env.mustRun("restore", "~/d", "--ago", "1")
+	if content, _ := os.ReadFile(filepath.Join(env.home, "d", "a")); string(content) != "first\n" {
+		t.Errorf("d/a = %q after restore, want the old version", content)
+	}
+	if _, err := os.Stat(filepath.Join(env.home, "d", "b")); !os.IsNotExist(err) {
+		t.Errorf("d/b, added after that version, is still there: %v", err)
+	}
+
+	// The replaced directory is in the backup
+	backups, _ := filepath.Glob(filepath.Join(env.folder, ".backups", "*", md5Hash("~/d"), "d", "b"))
+	if len(backups) != 1 {
+		t.Errorf("found %d backups of d/b, want 1", len(backups))
+	}
+}
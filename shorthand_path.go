@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
@@ -29,38 +30,45 @@ func (self ShorthandPath) Suffix(str string) ShorthandPath {
 	}
 }
 
-// expandFromTilde converts a tilde-prefixed path to an absolute path
-func expandFromTilde(path string) string {
-	if !strings.HasPrefix(path, "~/") && path != "~" {
-		absolutePath, _ := filepath.Abs(path)
-		return absolutePath
+// homeDir returns the directory ~ stands for: $HOME (%USERPROFILE% on Windows) when set,
+// else the current user's home, so tests and sandboxes can point it at a temp dir
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
 	}
-
 	currentUser, err := user.Current()
 	if err != nil {
 		log.Fatalf("Could not get the current user information")
 	}
+	return currentUser.HomeDir
+}
 
-	homeDir := currentUser.HomeDir
+// expandFromTilde converts a tilde-prefixed path to an absolute path
+func expandFromTilde(path string) string {
+	if !strings.HasPrefix(path, "~/") && path != "~" {
+		absolutePath, _ := filepath.Abs(path)
+		return absolutePath
+	}
 
+	home := homeDir()
 	if path == "~" {
-		return homeDir
+		return home
 	}
 
-	return filepath.Clean(filepath.Join(homeDir, path[2:]))
+	return filepath.Clean(filepath.Join(home, path[2:]))
 }
 
-// collapseToTilde converts an absolute home-dir path to tilde notation
+// collapseToTilde converts a path inside the home dir to tilde notation, other paths become absolute
 func collapseToTilde(path string) string {
-	if strings.HasPrefix(path, "~/") {
-		return path
+	if strings.HasPrefix(path, "~/") || path == "~" {
+		return filepath.Clean(path)
 	}
 
-	currentUser, err := user.Current()
-	if err != nil {
-		log.Fatalf("Could not get the current user information")
+	home := homeDir()
+	absolutePath, _ := filepath.Abs(path)
+	if !insideFolder(home, absolutePath) {
+		return absolutePath
 	}
-	homeDir := currentUser.HomeDir
-
-	return filepath.Clean(filepath.Join("~/", path[len(homeDir):]))
+	relative, _ := filepath.Rel(home, absolutePath)
+	return filepath.Join("~", relative)
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SigningConfig configures commit signing on push and signature verification on pull
+// It can be set in config.json (shared) and overridden in local.json (this machine only)
+type SigningConfig struct {
+	Format      string   `json:"format,omitempty"`       // "ssh" or "gpg", empty disables signing
+	Key         string   `json:"key,omitempty"`          // Passed as user.signingkey, git's default key when empty
+	Verify      bool     `json:"verify,omitempty"`       // Refuse to restore commits not signed by a trusted key
+	TrustedKeys []string `json:"trusted_keys,omitempty"` // SSH public keys or GPG fingerprints, read from config.json only
+}
+
+// Enabled reports whether commits should be signed
+func (s SigningConfig) Enabled() bool {
+	return s.Format != ""
+}
+
+// gitArgs returns the `-c` options that make git sign with the configured key
+func (s SigningConfig) gitArgs() []string {
+	if !s.Enabled() {
+		return nil
+	}
+
+	format := s.Format
+	if format == "gpg" {
+		format = "openpgp"
+	}
+	args := []string{"-c", "gpg.format=" + format}
+	if s.Key != "" {
+		args = append(args, "-c", "user.signingkey="+s.Key)
+	}
+	return args
+}
+
+// SigningSettings merges the signing section of config.json with the local.json overrides
+// Trusted keys are only ever taken from config.json, so they are reviewed like any other commit
+func (c *JsonConfig) SigningSettings() (SigningConfig, error) {
+	var settings SigningConfig
+	if err := c.checkInitialized(); err != nil {
+		return settings, err
+	}
+
+	if c.Signing != nil {
+		settings = *c.Signing
+	}
+
+	local, err := LoadLocalSettings(c.folder)
+	if err != nil {
+		return settings, err
+	}
+	if local.Signing != nil {
+		if local.Signing.Format != "" {
+			settings.Format = local.Signing.Format
+		}
+		if local.Signing.Key != "" {
+			settings.Key = local.Signing.Key
+		}
+		settings.Verify = settings.Verify || local.Signing.Verify
+	}
+
+	switch settings.Format {
+	case "", "ssh", "gpg":
+	default:
+		return settings, fmt.Errorf("unknown signing format %q (expected \"ssh\" or \"gpg\")", settings.Format)
+	}
+
+	return settings, nil
+}
+
+// isSSHKey reports whether a trusted key entry is an SSH public key rather than a GPG fingerprint
+func isSSHKey(key string) bool {
+	return strings.HasPrefix(key, "ssh-") || strings.HasPrefix(key, "ecdsa-") || strings.HasPrefix(key, "sk-")
+}
+
+// normalizeFingerprint uppercases a GPG fingerprint and strips the spaces gpg prints in it
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+}
+
+// VerifyCommits returns the commits in revRange that are not signed by one of the trusted keys
+// Each entry is "<short hash> <reason>", an empty result means every commit is trusted
+func (g RealGitRunner) VerifyCommits(ctx context.Context, revRange string, trustedKeys []string) ([]string, error) {
+	if len(trustedKeys) == 0 {
+		return nil, fmt.Errorf("signature verification is enabled but signing.trusted_keys in config.json is empty")
+	}
+
+	var sshKeys []string
+	trustedFingerprints := make(map[string]bool)
+	for _, key := range trustedKeys {
+		if isSSHKey(key) {
+			sshKeys = append(sshKeys, key)
+		} else {
+			trustedFingerprints[normalizeFingerprint(key)] = true
+		}
+	}
+
+	// git only accepts SSH signatures from keys listed in an allowed signers file
+	signersFile, err := os.CreateTemp("", "config-sync-allowed-signers-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(signersFile.Name())
+	for _, key := range sshKeys {
+		fmt.Fprintf(signersFile, "* %s\n", key)
+	}
+	signersFile.Close()
+
+	listing, err := g.output(ctx, "-c", "gpg.ssh.allowedSignersFile="+signersFile.Name(),
+		"log", "--format=%H%x1f%G?%x1f%GF%x1f%GP", revRange)
+	if err != nil {
+		return nil, err
+	}
+
+	var untrusted []string
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		commit, status, fingerprint, primary := fields[0], fields[1], fields[2], fields[3]
+
+		if reason := untrustedReason(status, fingerprint, primary, trustedFingerprints); reason != "" {
+			untrusted = append(untrusted, fmt.Sprintf("%s %s", shortHash(commit), reason))
+		}
+	}
+
+	return untrusted, nil
+}
+
+// untrustedReason explains why a commit signature isn't trusted, or returns "" if it is
+// status is git's %G? placeholder: G good, U good with unknown validity, N none, B bad, ...
+func untrustedReason(status, fingerprint, primary string, trustedFingerprints map[string]bool) string {
+	switch status {
+	case "N":
+		return "is not signed"
+	case "G", "U":
+	default:
+		return fmt.Sprintf("has an invalid or unverifiable signature (%s)", status)
+	}
+
+	// SSH signatures only verify as good when the key is in the allowed signers file
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		if status == "G" {
+			return ""
+		}
+		return "is signed by an untrusted SSH key"
+	}
+
+	if trustedFingerprints[normalizeFingerprint(fingerprint)] || trustedFingerprints[normalizeFingerprint(primary)] {
+		return ""
+	}
+	return fmt.Sprintf("is signed by an untrusted key %s", fingerprint)
+}
+
+// pullVerified fetches the remote and only merges it if every incoming commit is trusted
+func pullVerified(ctx context.Context, git GitRunner, trustedKeys []string) error {
+	if err := git.Fetch(ctx); err != nil {
+		return err
+	}
+
+	revRange := "HEAD..FETCH_HEAD"
+	if _, err := git.ResolveRevision(ctx, "HEAD"); err != nil {
+		// Nothing committed locally yet, every fetched commit is incoming
+		revRange = "FETCH_HEAD"
+	}
+
+	untrusted, err := git.VerifyCommits(ctx, revRange, trustedKeys)
+	if err != nil {
+		return err
+	}
+	if len(untrusted) > 0 {
+		return fmt.Errorf("refusing to restore unverified commits:\n  %s", strings.Join(untrusted, "\n  "))
+	}
+
+	return git.Merge(ctx, "FETCH_HEAD")
+}
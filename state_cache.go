@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fileState is what we remember about a file to avoid hashing it again
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash"`
+}
+
+// StateCache remembers file hashes between runs in ~/.config-sync/.state/
+// A file is only hashed again when its size or modification time changed
+type StateCache struct {
+	Files  map[string]fileState `json:"files"`
+	folder ShorthandPath
+	path   string
+	dirty  bool
+	mu     sync.Mutex // Files are hashed in parallel
+}
+
+// LoadStateCache reads the state cache of the config folder
+// A missing or unreadable cache just starts empty
+func LoadStateCache(folder ShorthandPath) *StateCache {
+	cache := &StateCache{
+		Files:  make(map[string]fileState),
+		folder: folder,
+		path:   folder.Suffix(filepath.Join(".state", "files.json")).FullPath,
+	}
+
+	if content, err := os.ReadFile(cache.path); err == nil {
+		json.Unmarshal(content, cache)
+		if cache.Files == nil {
+			cache.Files = make(map[string]fileState)
+		}
+	}
+	return cache
+}
+
+// fileHash returns the cached hash of a file if its size and mtime still match
+func (s *StateCache) fileHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	cached, ok := s.Files[path]
+	s.mu.Unlock()
+	if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Hash, nil
+	}
+
+	hash, err := fileHash(path)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.Files[path] = fileState{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+	s.dirty = true
+	s.mu.Unlock()
+	return hash, nil
+}
+
+// Prune drops the entries of files outside roots, e.g. of paths that are no longer tracked
+func (s *StateCache) Prune(roots []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.Files {
+		if !slices.ContainsFunc(roots, func(root string) bool { return insideFolder(root, path) }) {
+			delete(s.Files, path)
+			s.dirty = true
+		}
+	}
+}
+
+// Save writes the cache back if anything changed
+func (s *StateCache) Save() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := ensureLocalIgnores(s.folder); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	content, _ := json.Marshal(s)
+	if err := writeStateFile(s.path, content); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// writeStateFile replaces a file in .state/ through a temp file next to it
+// Checks and background refreshes write state without holding the repository lock, a rename never leaves it half written
+func writeStateFile(path string, content []byte) error {
+	temp := path + "." + strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(temp, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// RemoteState is the last known head of main on the primary remote, stored in .state/remote.json
+type RemoteState struct {
+	Head             string    `json:"head"`
+	CheckedAt        time.Time `json:"checked_at"`
+	RefreshStartedAt time.Time `json:"refresh_started_at,omitzero"`
+	Unreachable      bool      `json:"unreachable,omitempty"` // The last refresh couldn't reach the remote
+}
+
+// remoteStatePath returns where the remote state of a config folder is stored
+func remoteStatePath(folder ShorthandPath) string {
+	return folder.Suffix(filepath.Join(".state", "remote.json")).FullPath
+}
+
+// LoadRemoteState reads the cached remote head, an empty state means it was never checked
+func LoadRemoteState(folder ShorthandPath) RemoteState {
+	var state RemoteState
+	if content, err := os.ReadFile(remoteStatePath(folder)); err == nil {
+		json.Unmarshal(content, &state)
+	}
+	return state
+}
+
+// Save writes the remote state to the config folder
+func (r RemoteState) Save(folder ShorthandPath) error {
+	if err := ensureLocalIgnores(folder); err != nil {
+		return err
+	}
+	path := remoteStatePath(folder)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	content, _ := json.Marshal(r)
+	return writeStateFile(path, content)
+}
+
+// Fresh reports whether the cached head was checked within ttl
+func (r RemoteState) Fresh(ttl time.Duration) bool {
+	return !r.CheckedAt.IsZero() && time.Since(r.CheckedAt) < ttl
+}
+
+// refreshing reports whether a background refresh was started recently enough to still be running
+func (r RemoteState) refreshing(timeout time.Duration) bool {
+	return !r.RefreshStartedAt.IsZero() && time.Since(r.RefreshStartedAt) < 2*timeout
+}
+
+// RecordRemoteHead stores a remote head we learned about for free, e.g. right after a push
+func RecordRemoteHead(folder ShorthandPath, head string) error {
+	return RemoteState{Head: head, CheckedAt: time.Now()}.Save(folder)
+}
+
+// RefreshRemoteState asks the primary remote for its head and caches it
+// When the remote is unreachable the old head is kept, so prompts don't retry on every render
+func RefreshRemoteState(ctx context.Context, git GitRunner, folder ShorthandPath) error {
+	state := LoadRemoteState(folder)
+	head, err := git.RemoteHead(ctx, primaryRemote)
+	if err == nil {
+		state.Head = head
+	}
+	state.Unreachable = err != nil && ctx.Err() == nil
+	state.CheckedAt = time.Now()
+	state.RefreshStartedAt = time.Time{}
+	if saveErr := state.Save(folder); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// refreshRemoteStateInBackground starts a detached `check-updates --refresh-remote`
+// The current check answers from the stale cache and the next one sees the new head
+func refreshRemoteStateInBackground(folder ShorthandPath, state RemoteState, timeout time.Duration) error {
+	if state.refreshing(timeout) {
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	state.RefreshStartedAt = time.Now()
+	if err := state.Save(folder); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, "--home", folder.FullPath, "check-updates", "--refresh-remote")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
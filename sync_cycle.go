@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// commitLocalChanges copies the tracked files into the repository and commits them
+// with a generated message, userMessage replaces the generated subject if set
+// Returns false when nothing changed
+func commitLocalChanges(ctx context.Context, git GitRunner, config *JsonConfig, userMessage string) (bool, error) {
+	// Auto-init git repo if needed
+	if err := git.Init(ctx); err != nil {
+		return false, fmt.Errorf("git init failed: %w", err)
+	}
+
+	// Sync files to synced-folder
+	if err := config.SyncFiles(ctx); err != nil {
+		return false, fmt.Errorf("sync failed: %w", err)
+	}
+
+	if err := git.Add(ctx); err != nil {
+		return false, fmt.Errorf("git add failed: %w", err)
+	}
+	summary, err := config.SummarizeStagedChanges(ctx, git)
+	if err != nil {
+		return false, fmt.Errorf("reading staged changes failed: %w", err)
+	}
+	if summary.IsEmpty() {
+		return false, nil
+	}
+	if err := git.Commit(ctx, BuildCommitMessage(summary, userMessage)); err != nil {
+		return false, fmt.Errorf("git commit failed: %w", err)
+	}
+	return true, nil
+}
+
+// pushCommits pushes to every push-enabled remote and caches the pushed head
+func pushCommits(ctx context.Context, git GitRunner) error {
+	if err := git.Push(ctx); err != nil {
+		return err
+	}
+
+	// The remote now has our HEAD, no need to ask it on the next check
+	if head, err := git.ResolveRevision(ctx, "HEAD"); err == nil {
+		RecordRemoteHead(configFolder(), head)
+	}
+	return nil
+}
+
+// pullChanges pulls remote changes without restoring anything
+// Incoming commits are verified first when verify is set or signing.verify is configured
+func pullChanges(ctx context.Context, git GitRunner, verify bool) error {
+	signing := git.Signing()
+	if verify || signing.Verify {
+		return pullVerified(ctx, git, signing.TrustedKeys)
+	}
+	return git.Pull(ctx)
+}
+
+// pullAndRestore pulls remote changes and restores the tracked files to their locations
+func pullAndRestore(ctx context.Context, git GitRunner, config *JsonConfig, verify bool) error {
+	if err := pullChanges(ctx, git, verify); err != nil {
+		return err
+	}
+
+	// The pull may have tracked or untracked paths on another machine
+	if err := config.Reload(); err != nil {
+		return fmt.Errorf("reloading config failed: %w", err)
+	}
+	if err := config.RestoreFiles(ctx); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+
+	// The fetched head is what the remote has right now
+	if head, err := git.ResolveRevision(ctx, "FETCH_HEAD"); err == nil {
+		RecordRemoteHead(configFolder(), head)
+	}
+	return nil
+}
+
+// networkError marks sync failures that are worth retrying later
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string { return e.err.Error() }
+func (e *networkError) Unwrap() error { return e.err }
+
+// conflictError marks a merge conflict, nothing syncs until it's resolved by hand
+type conflictError struct {
+	err error
+}
+
+func (e *conflictError) Error() string { return e.err.Error() }
+func (e *conflictError) Unwrap() error { return e.err }
+
+// syncCycle commits local edits, pulls remote changes and pushes, as watch mode and the daemon do
+// Local edits are committed before anything is pulled, so a pull merges instead of overwriting them
+// postponePull is asked before restoring pulled files, returning true leaves the pull for the next cycle
+func syncCycle(ctx context.Context, config *JsonConfig, postponePull func() bool) error {
+	dir := config.folder.FullPath
+
+	lock, err := AcquireRepoLock(config.folder, true, appTimeouts.LockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// A manual track or pull may have changed config.json since the last cycle
+	if err := config.Reload(); err != nil {
+		return err
+	}
+
+	// A conflict left by an earlier pull must be resolved by hand first
+	if isMergeConflict(dir) {
+		return pullConflictError()
+	}
+
+	git, err := NewConfiguredGitRunner(config)
+	if err != nil {
+		return err
+	}
+
+	committed, err := commitLocalChanges(ctx, git, config, "")
+	if err != nil {
+		return err
+	}
+	if committed {
+		log.Println("Committed local changes")
+	}
+
+	// One ls-remote tells us whether the remote is reachable and whether there's anything to pull
+	// Pull and push classify their own failures, an unreachable remote comes back as a networkError
+	head, err := git.RemoteHead(ctx, primaryRemote)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Interrupted, not unreachable
+			return err
+		}
+		return &networkError{err}
+	}
+	RecordRemoteHead(config.folder, head)
+
+	checker := &CachedStateChecker{NewCheckStrategy(git, config, dir, NewTimingLogger("", false))}
+	if unpulled, _ := checker.CheckUnpulled(ctx); unpulled {
+		if postponePull != nil && postponePull() {
+			log.Println("Local edits in progress, pulling on the next sync")
+		} else if err := pullAndRestore(ctx, git, config, false); err != nil {
+			return err
+		}
+	}
+
+	if unpushed, _ := git.HasUnpushedChanges(ctx); unpushed {
+		if err := pushCommits(ctx, git); err != nil {
+			return err
+		}
+		log.Println("Pushed local changes")
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tracked file states reported by the check strategies
+const (
+	FileInSync   = "in-sync"
+	FileModified = "modified" // Source differs from its synced copy
+	FileNew      = "new"      // Tracked but never synced
+	FileMissing  = "missing"  // Source doesn't exist on this machine
+)
+
+// Overall sync states
+const (
+	StateInSync    = "in-sync"
+	StateNeedsPush = "needs-push"
+	StateNeedsPull = "needs-pull"
+	StateDiverged  = "diverged"
+	StateUnknown   = "unknown" // A check failed and nothing else needs syncing, see Errors
+)
+
+// Exit codes of check-updates and status in machine-readable modes (1 is left for errors)
+const (
+	ExitInSync    = 0
+	ExitNeedsPush = 2
+	ExitNeedsPull = 3
+	ExitDiverged  = 4
+)
+
+// FileStatus is the check result of one tracked path
+type FileStatus struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+// anyUnsynced reports whether any tracked path has changes to push
+func anyUnsynced(files []FileStatus) bool {
+	for _, file := range files {
+		if file.Status == FileModified || file.Status == FileNew {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncStatus is the combined result of all checks
+type SyncStatus struct {
+	State    string         `json:"state"`
+	Unsynced bool           `json:"unsynced"`
+	Unpushed bool           `json:"unpushed"`
+	Unpulled bool           `json:"unpulled"`
+	Files    []FileStatus   `json:"files"`
+	Remotes  []RemoteStatus `json:"remotes,omitempty"`
+	Timings  []TimingEntry  `json:"timings"`
+	Watch    *WatchStatus   `json:"watch,omitempty"`  // Set when a watch is running
+	Errors   []string       `json:"errors,omitempty"` // Checks that failed, their results are left out
+	Busy     bool           `json:"busy,omitempty"`   // Another run held the lock, the answer comes from cached state
+}
+
+// RunSyncChecks runs every check of a strategy and combines the results
+// Per-remote status is only checked when mirrors are configured, to keep the common case fast.
+// Failed checks are listed in the status and returned joined, an unreachable remote as a networkError
+func RunSyncChecks(ctx context.Context, checker Checker, git GitRunner, logger *TimingLogger) (SyncStatus, error) {
+	var status SyncStatus
+	var errs []error
+	record := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+			status.Errors = append(status.Errors, err.Error())
+		}
+	}
+
+	var err error
+	status.Files, err = checker.CheckUnsyncedFiles(ctx)
+	record(err)
+	status.Unsynced = anyUnsynced(status.Files)
+	status.Unpushed, err = checker.CheckUnpushed(ctx)
+	record(err)
+	status.Unpulled, err = checker.CheckUnpulled(ctx)
+	record(err)
+
+	remotes, err := git.Remotes(ctx)
+	record(err)
+	if len(remotes) > 1 {
+		status.Remotes, err = checker.CheckRemotes(ctx)
+		record(err)
+	}
+
+	needsPush := status.Unsynced || status.Unpushed
+	for _, remote := range status.Remotes {
+		if remote.Reachable && !remote.InSync && !status.Unpulled {
+			needsPush = true
+		}
+	}
+
+	switch {
+	case needsPush && status.Unpulled:
+		status.State = StateDiverged
+	case needsPush:
+		status.State = StateNeedsPush
+	case status.Unpulled:
+		status.State = StateNeedsPull
+	case len(errs) > 0:
+		status.State = StateUnknown
+	default:
+		status.State = StateInSync
+	}
+
+	status.Timings = logger.Entries()
+	return status, errors.Join(errs...)
+}
+
+// InSync reports whether there is nothing to push or pull and every remote is up to date
+func (s SyncStatus) InSync() bool {
+	if s.State != StateInSync {
+		return false
+	}
+	for _, remote := range s.Remotes {
+		if !remote.InSync {
+			return false
+		}
+	}
+	return true
+}
+
+// ExitCode maps the sync state to the documented exit code
+func (s SyncStatus) ExitCode() int {
+	switch s.State {
+	case StateNeedsPush:
+		return ExitNeedsPush
+	case StateNeedsPull:
+		return ExitNeedsPull
+	case StateDiverged:
+		return ExitDiverged
+	default:
+		return ExitInSync
+	}
+}
+
+// HumanLines describes the status for people
+func (s SyncStatus) HumanLines() []string {
+	msgs := s.syncLines()
+	if s.Busy {
+		msgs = append(msgs, "", "Another config-sync run is using the repository, this answer comes from cached state")
+	}
+	if s.Watch != nil {
+		msgs = append(msgs, "", s.Watch.Describe())
+	}
+	return msgs
+}
+
+// syncLines describes what needs to be pushed or pulled
+func (s SyncStatus) syncLines() []string {
+	if s.InSync() {
+		return []string{"Your config is up to date"}
+	}
+
+	if s.State == StateUnknown {
+		msgs := []string{"Could not check whether your config is up to date:"}
+		for _, err := range s.Errors {
+			msgs = append(msgs, "  • "+err)
+		}
+		return msgs
+	}
+
+	msgs := []string{"Your config is out of sync:"}
+	if s.Unsynced {
+		msgs = append(msgs, "  • Some tracked files have changed")
+		for _, file := range s.Files {
+			if file.Status == FileModified || file.Status == FileNew {
+				msgs = append(msgs, fmt.Sprintf("      %s (%s)", file.Path, file.Status))
+			}
+		}
+	}
+	if s.Unpushed {
+		msgs = append(msgs, "  • You have local changes not pushed")
+	}
+	if s.Unpulled {
+		msgs = append(msgs, "  • There are remote changes not pulled")
+	}
+	for _, remote := range s.Remotes {
+		if !remote.Reachable {
+			msgs = append(msgs, fmt.Sprintf("  • Remote %s is unreachable", remote.Name))
+		} else if !remote.InSync {
+			msgs = append(msgs, fmt.Sprintf("  • Remote %s is not in sync", remote.Name))
+		}
+	}
+	for _, err := range s.Errors {
+		msgs = append(msgs, "  • Could not check: "+err)
+	}
+
+	msgs = append(msgs, "")
+	switch s.State {
+	case StateNeedsPull:
+		msgs = append(msgs, "Run: config-sync pull")
+	case StateDiverged:
+		msgs = append(msgs, "Run: config-sync pull, then config-sync push")
+	default:
+		msgs = append(msgs, "Run: config-sync push")
+	}
+	return msgs
+}
+
+// WriteJSON writes the status as a single JSON object
+func (s SyncStatus) WriteJSON(w io.Writer) error {
+	if s.Files == nil {
+		s.Files = []FileStatus{}
+	}
+	if s.Timings == nil {
+		s.Timings = []TimingEntry{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// WritePorcelain writes the status as stable "<key> <value...>" lines for scripts
+func (s SyncStatus) WritePorcelain(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "state %s\n", s.State)
+	fmt.Fprintf(&b, "unsynced %t\n", s.Unsynced)
+	fmt.Fprintf(&b, "unpushed %t\n", s.Unpushed)
+	fmt.Fprintf(&b, "unpulled %t\n", s.Unpulled)
+	for _, file := range s.Files {
+		fmt.Fprintf(&b, "file %s %s\n", file.Status, file.Path)
+	}
+	for _, remote := range s.Remotes {
+		state := "in-sync"
+		if !remote.Reachable {
+			state = "unreachable"
+		} else if !remote.InSync {
+			state = "out-of-sync"
+		}
+		fmt.Fprintf(&b, "remote %s %s\n", state, remote.Name)
+	}
+	if s.Busy {
+		fmt.Fprintf(&b, "busy true\n")
+	}
+	if s.Watch != nil {
+		fmt.Fprintf(&b, "watch %s %d\n", s.Watch.State, s.Watch.PID)
+	}
+	for _, err := range s.Errors {
+		fmt.Fprintf(&b, "error %s\n", strings.ReplaceAll(err, "\n", " "))
+	}
+	for _, timing := range s.Timings {
+		fmt.Fprintf(&b, "timing %d %s\n", timing.Ms, timing.Operation)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TimeoutConfig defines timeouts for different operations
+type TimeoutConfig struct {
+	GitRemote time.Duration // ls-remote (default 5s)
+	GitLocal  time.Duration // status, rev-list, diff (default 2s)
+	FileCopy  time.Duration // a file copy getting no data (default 10s)
+	FileStat  time.Duration // file stat checks (default 500ms)
+	RemoteTTL time.Duration // how long a cached remote head is trusted (default 5m)
+	LockWait  time.Duration // waiting for another config-sync run to finish (default 10s)
+}
+
+// DefaultTimeouts returns default timeout configuration
+func DefaultTimeouts() TimeoutConfig {
+	return TimeoutConfig{
+		GitRemote: 5 * time.Second,
+		GitLocal:  2 * time.Second,
+		FileCopy:  10 * time.Second,
+		FileStat:  500 * time.Millisecond,
+		RemoteTTL: 5 * time.Minute,
+		LockWait:  10 * time.Second,
+	}
+}
+
+// appTimeouts are the timeouts in effect, resolved once the config is loaded
+var appTimeouts = DefaultTimeouts()
+
+// timeoutFlags holds the --timeout key=duration overrides from the command line
+var timeoutFlags map[string]string
+
+// timeoutFields maps the names used in config.json, env vars and flags to TimeoutConfig fields
+func (t *TimeoutConfig) timeoutFields() map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"git_remote": &t.GitRemote,
+		"git_local":  &t.GitLocal,
+		"file_copy":  &t.FileCopy,
+		"file_stat":  &t.FileStat,
+		"remote_ttl": &t.RemoteTTL,
+		"lock_wait":  &t.LockWait,
+	}
+}
+
+// timeoutNames returns the configurable timeout names in sorted order
+func timeoutNames() []string {
+	var names []string
+	for name := range new(TimeoutConfig).timeoutFields() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveTimeouts layers the timeouts: defaults, then config.json, then
+// CONFIG_SYNC_TIMEOUT_<NAME> env vars, then --timeout flags
+// A duration of 0 disables the timeout
+func ResolveTimeouts(config *JsonConfig) (TimeoutConfig, error) {
+	timeouts := DefaultTimeouts()
+	fields := timeouts.timeoutFields()
+
+	set := func(source, name, value string) error {
+		field, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown timeout %q in %s (available: %s)", name, source, strings.Join(timeoutNames(), ", "))
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid %s timeout %q in %s (expected a duration like 500ms or 5s)", name, value, source)
+		}
+		*field = duration
+		return nil
+	}
+
+	if config != nil {
+		for name, value := range config.Timeouts {
+			if err := set("config.json", name, value); err != nil {
+				return timeouts, err
+			}
+		}
+	}
+	for _, name := range timeoutNames() {
+		env := "CONFIG_SYNC_TIMEOUT_" + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := set(env, name, value); err != nil {
+				return timeouts, err
+			}
+		}
+	}
+	for name, value := range timeoutFlags {
+		if err := set("--timeout", name, value); err != nil {
+			return timeouts, err
+		}
+	}
+
+	return timeouts, nil
+}
+
+// statWithTimeout stats a path, giving up after timeout (slow network mounts can hang forever)
+func statWithTimeout(path string, timeout time.Duration) (os.FileInfo, error) {
+	if timeout <= 0 {
+		return os.Stat(path)
+	}
+
+	type result struct {
+		info os.FileInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := os.Stat(path)
+		done <- result{info, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.info, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("stat %s timed out after %s", path, timeout)
+	}
+}
+
+// stallWatchdog closes a file that gets no data within timeout, so the read waiting on it fails
+// A copy that keeps making progress is never cut short, however big the file or slow the disk
+type stallWatchdog struct {
+	timer   *time.Timer
+	timeout time.Duration
+	stalled atomic.Bool
+}
+
+// watchStall starts watching reads from file, 0 disables the limit. Stop it once the copy ends
+func watchStall(file *os.File, timeout time.Duration) *stallWatchdog {
+	w := &stallWatchdog{timeout: timeout}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			w.stalled.Store(true)
+			file.Close()
+		})
+	}
+	return w
+}
+
+// progress restarts the countdown after data arrived
+func (w *stallWatchdog) progress() {
+	if w.timer != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// Stop ends the watch and returns the copy's error, reported as a stall when the watchdog closed the file
+func (w *stallWatchdog) Stop(err error) error {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if err != nil && w.stalled.Load() {
+		return fmt.Errorf("copy stalled, no data for %s", w.timeout)
+	}
+	return err
+}
+
+// noCopyTimeoutKey marks a context whose copies ignore the file_copy timeout
+type noCopyTimeoutKey struct{}
+
+// withoutCopyTimeout exempts the copies made with ctx from the file_copy timeout,
+// for rollbacks that have to finish however slow the disk is
+func withoutCopyTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCopyTimeoutKey{}, true)
+}
+
+// copyTimeout returns the file_copy timeout that applies to copies made with ctx
+func copyTimeout(ctx context.Context) time.Duration {
+	if ctx.Value(noCopyTimeoutKey{}) != nil {
+		return 0
+	}
+	return appTimeouts.FileCopy
+}
+
+// timeoutContext returns a child of parent that expires after timeout, 0 disables the limit
+func timeoutContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
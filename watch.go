@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watch loop states reported over the status socket
+const (
+	WatchIdle     = "watching"
+	WatchSyncing  = "syncing"
+	WatchBackoff  = "backoff"  // Remote unreachable, waiting before the next attempt
+	WatchConflict = "conflict" // Pull hit a merge conflict, syncing is paused until it's resolved
+)
+
+// WatchOptions tune the watch loop
+type WatchOptions struct {
+	Debounce     time.Duration // Quiet time after the last edit before syncing
+	PullInterval time.Duration // How often remote changes are pulled without local edits
+	MaxBackoff   time.Duration // Longest wait between retries while the remote is unreachable
+}
+
+// DefaultWatchOptions returns the default watch loop settings
+func DefaultWatchOptions() WatchOptions {
+	return WatchOptions{
+		Debounce:     2 * time.Second,
+		PullInterval: 5 * time.Minute,
+		MaxBackoff:   10 * time.Minute,
+	}
+}
+
+// minBackoff is the first wait after a network failure, doubled on every further failure
+const minBackoff = 15 * time.Second
+
+// WatchStatus is what a running watch reports over its status socket
+type WatchStatus struct {
+	PID       int       `json:"pid"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+	Paths     int       `json:"paths"`
+	LastSync  time.Time `json:"last_sync,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+	RetryAt   time.Time `json:"retry_at,omitzero"`
+}
+
+// Describe summarizes the watch status in one line for people
+func (w WatchStatus) Describe() string {
+	line := fmt.Sprintf("Watch mode is running (pid %d, %d paths)", w.PID, w.Paths)
+	lastError, _, _ := strings.Cut(w.LastError, "\n")
+	switch w.State {
+	case WatchConflict:
+		return line + ", paused until the merge conflict in " + configFolder().TildePath + " is resolved"
+	case WatchBackoff:
+		return fmt.Sprintf("%s, retrying at %s: %s", line, w.RetryAt.Format(time.TimeOnly), lastError)
+	}
+	if !w.LastSync.IsZero() {
+		line += ", last synced at " + w.LastSync.Format(time.TimeOnly)
+	}
+	return line
+}
+
+// watchSocketPath is where a running watch answers status queries
+func watchSocketPath(folder ShorthandPath) string {
+	return folder.Suffix(filepath.Join(".state", "watch.sock")).FullPath
+}
+
+// QueryWatchStatus asks a running watch for its status, returning an error if none is running
+func QueryWatchStatus(folder ShorthandPath) (*WatchStatus, error) {
+	conn, err := net.DialTimeout("unix", watchSocketPath(folder), 200*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	var status WatchStatus
+	if err := json.NewDecoder(conn).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// watchLoop pushes local edits and pulls remote changes as they happen
+type watchLoop struct {
+	config   *JsonConfig
+	options  WatchOptions
+	watcher  changeWatcher
+	notifier Notifier
+	backoff  time.Duration
+
+	mu     sync.Mutex
+	status WatchStatus
+}
+
+// RunWatch watches every tracked path and keeps them in sync until ctx is cancelled
+//
+// Conflict safety:
+//   - local edits are always committed before anything is pulled, so a pull merges instead of overwriting
+//   - remote changes are not restored while local edits are still coming in
+//   - a merge conflict pauses syncing until it's resolved by hand
+func RunWatch(ctx context.Context, config *JsonConfig, options WatchOptions) error {
+	notifier, err := LoadNotifier(config.folder)
+	if err != nil {
+		return err
+	}
+	listener, err := listenWatchSocket(config.folder)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	w := &watchLoop{
+		config:   config,
+		options:  options,
+		notifier: notifier,
+		status:   WatchStatus{PID: os.Getpid(), State: WatchIdle, StartedAt: time.Now()},
+	}
+	go w.serveStatus(listener)
+
+	if err := w.startWatcher(); err != nil {
+		return err
+	}
+	defer func() { w.watcher.Close() }()
+
+	// Catch up on edits made while nothing was watching
+	w.sync(ctx)
+
+	var debounce, retry <-chan time.Time
+	pending := false
+	runSync := func() {
+		pending = false
+		retry = w.afterSync(w.sync(ctx))
+	}
+	pull := time.NewTicker(options.PullInterval)
+	defer pull.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if pending {
+				// The signal that stopped us shouldn't cancel this last sync, a second one still kills
+				log.Println("Syncing pending changes before exiting")
+				w.sync(context.WithoutCancel(ctx))
+			}
+			log.Println("Watch stopped")
+			return nil
+
+		case path, ok := <-w.watcher.Changes():
+			if !ok {
+				return errors.New("file watcher stopped unexpectedly")
+			}
+			if path == w.configPath() {
+				// Tracked paths may have changed, watch the new set
+				if err := w.reload(); err != nil {
+					log.Printf("Reloading config failed: %v\n", err)
+				}
+			}
+			pending = true
+			debounce = time.After(options.Debounce)
+
+		case <-debounce:
+			// While backing off, the retry picks up the edits
+			debounce = nil
+			if !w.waitingForRetry() {
+				runSync()
+			}
+
+		case <-pull.C:
+			if !w.waitingForRetry() {
+				runSync()
+			}
+
+		case <-retry:
+			runSync()
+		}
+	}
+}
+
+// listenWatchSocket creates the status socket, refusing to start a second watch
+func listenWatchSocket(folder ShorthandPath) (net.Listener, error) {
+	if running, err := QueryWatchStatus(folder); err == nil {
+		return nil, fmt.Errorf("watch is already running (pid %d)", running.PID)
+	}
+
+	path := watchSocketPath(folder)
+	if err := ensureLocalIgnores(folder); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// Left behind by a watch that was killed
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+// serveStatus answers every connection with the current status as JSON
+func (w *watchLoop) serveStatus(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		w.mu.Lock()
+		status := w.status
+		w.mu.Unlock()
+		json.NewEncoder(conn).Encode(status)
+		conn.Close()
+	}
+}
+
+// configPath is config.json, watched so newly tracked paths are picked up
+func (w *watchLoop) configPath() string {
+	return w.config.folder.Suffix("config.json").TildePath
+}
+
+// startWatcher watches the tracked paths and config.json
+func (w *watchLoop) startWatcher() error {
+	paths := []string{w.configPath()}
+	for tildePath := range w.config.Files {
+		paths = append(paths, tildePath)
+	}
+	watcher, err := newChangeWatcher(paths)
+	if err != nil {
+		return fmt.Errorf("watching tracked files failed: %w", err)
+	}
+	w.watcher = watcher
+
+	w.mu.Lock()
+	w.status.Paths = len(w.config.Files)
+	w.mu.Unlock()
+	log.Printf("Watching %d tracked paths\n", len(w.config.Files))
+	return nil
+}
+
+// reload reads config.json again and restarts the watcher for the new set of paths
+func (w *watchLoop) reload() error {
+	if err := w.config.Reload(); err != nil {
+		return err
+	}
+	w.watcher.Close()
+	return w.startWatcher()
+}
+
+// sync runs one push/pull cycle, returning the error that ended it early
+func (w *watchLoop) sync(ctx context.Context) error {
+	w.setState(WatchSyncing, nil)
+	// Restoring while edits are still coming in could overwrite one that isn't committed yet
+	editsInProgress := func() bool { return len(w.watcher.Changes()) > 0 }
+	if err := syncCycle(ctx, w.config, editsInProgress); err != nil {
+		var conflict *conflictError
+		if errors.As(err, &conflict) {
+			// Only notify when the conflict is new, not on every sync while it's unresolved
+			if w.state() != WatchConflict {
+				log.Printf("Sync paused: %v\n", err)
+				if notifyErr := w.notifier.Notify(conflictTitle, conflictMessage()); notifyErr != nil {
+					log.Printf("Notification failed: %v\n", notifyErr)
+				}
+			}
+			w.setState(WatchConflict, err)
+			return err
+		}
+		if ctx.Err() != nil {
+			// Stopping, not failing
+			return err
+		}
+		return w.fail(err)
+	}
+
+	w.backoff = 0
+	w.mu.Lock()
+	w.status.State = WatchIdle
+	w.status.LastSync = time.Now()
+	w.status.LastError = ""
+	w.status.RetryAt = time.Time{}
+	w.mu.Unlock()
+	return nil
+}
+
+// fail records a failed sync, network failures back off exponentially
+func (w *watchLoop) fail(err error) error {
+	var netErr *networkError
+	if !errors.As(err, &netErr) {
+		log.Printf("Sync failed: %v\n", err)
+		w.setState(WatchIdle, err)
+		return err
+	}
+
+	w.backoff = min(max(2*w.backoff, minBackoff), w.options.MaxBackoff)
+	w.mu.Lock()
+	w.status.State = WatchBackoff
+	w.status.LastError = err.Error()
+	w.status.RetryAt = time.Now().Add(w.backoff)
+	w.mu.Unlock()
+	log.Printf("Sync failed, retrying in %s: %v\n", w.backoff, err)
+	return err
+}
+
+// afterSync returns the retry timer for a sync result, nil when no retry is needed
+func (w *watchLoop) afterSync(err error) <-chan time.Time {
+	var netErr *networkError
+	if errors.As(err, &netErr) {
+		return time.After(w.backoff)
+	}
+	return nil
+}
+
+// waitingForRetry reports whether the loop is backing off until its next retry
+func (w *watchLoop) waitingForRetry() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status.State == WatchBackoff && time.Now().Before(w.status.RetryAt)
+}
+
+func (w *watchLoop) state() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status.State
+}
+
+func (w *watchLoop) setState(state string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.State = state
+	if err != nil {
+		w.status.LastError = err.Error()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+)
+
+// changeWatcher reports which watched path changed
+// Paths are reported the way they were given, so tracked tilde paths come back as tilde paths
+type changeWatcher interface {
+	Changes() <-chan string
+	Close() error
+}
+
+// pollWatcher detects changes by comparing sizes and modification times at an interval
+// It's the fallback where inotify isn't available or its watch limit is reached
+type pollWatcher struct {
+	changes chan string
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newPollWatcher starts polling the given paths, each a tilde path or a full path
+func newPollWatcher(paths []string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		changes: make(chan string, len(paths)),
+		done:    make(chan struct{}),
+	}
+
+	fingerprints := make(map[string]string, len(paths))
+	for _, path := range paths {
+		fingerprints[path] = fingerprint(ShorthandPath{}.New(path).FullPath)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+			}
+			for _, path := range paths {
+				current := fingerprint(ShorthandPath{}.New(path).FullPath)
+				if current == fingerprints[path] {
+					continue
+				}
+				fingerprints[path] = current
+				select {
+				case w.changes <- path:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+// fingerprint summarizes the sizes and modification times of a file or directory tree
+func fingerprint(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	if !info.IsDir() {
+		return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	}
+
+	tree, err := statTree(path)
+	if err != nil {
+		return "unreadable"
+	}
+	// Summing per-entry hashes keeps the result independent of map order and catches renames
+	var sum uint64
+	for rel, entry := range tree {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s-%d-%d", rel, entry.Size(), entry.ModTime().UnixNano())
+		sum += h.Sum64()
+	}
+	return fmt.Sprintf("%d-%x", len(tree), sum)
+}
@@ -0,0 +1,214 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyMask covers writes, editor-style atomic replaces and files appearing or disappearing
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// watchTarget is a watched path served by one inotify watch
+// name is set when only one entry of the watched directory matters (a tracked file)
+type watchTarget struct {
+	path string
+	name string
+}
+
+// inotifyWatcher watches tracked files through their parent directory, so editors that
+// replace a file by renaming a temp file over it are still seen,
+// and tracked directories recursively, adding watches for directories created later
+type inotifyWatcher struct {
+	fd      int
+	file    *os.File
+	changes chan string
+	done    chan struct{}
+	mu      sync.Mutex
+	targets map[int32][]watchTarget
+	dirs    map[int32]string
+	paths   []string // Every watched tracked path, for a queue overflow
+	closed  bool
+}
+
+// newChangeWatcher watches paths with inotify, falling back to polling when inotify fails
+func newChangeWatcher(paths []string) (changeWatcher, error) {
+	w, err := newInotifyWatcher(paths)
+	if err != nil {
+		log.Printf("inotify unavailable (%v), polling for changes instead\n", err)
+		return newPollWatcher(paths, 2*time.Second), nil
+	}
+	return w, nil
+}
+
+func newInotifyWatcher(paths []string) (*inotifyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd: fd,
+		// A non-blocking fd goes through the runtime poller, so Close unblocks a pending Read
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan string, len(paths)),
+		done:    make(chan struct{}),
+		targets: make(map[int32][]watchTarget),
+		dirs:    make(map[int32]string),
+		paths:   paths,
+	}
+
+	for _, path := range paths {
+		if err := w.watchPath(path); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+// watchPath adds the watches for one tracked path
+func (w *inotifyWatcher) watchPath(path string) error {
+	fullPath := ShorthandPath{}.New(path).FullPath
+	info, err := os.Stat(fullPath)
+	if err == nil && info.IsDir() {
+		return w.watchTree(fullPath, path)
+	}
+	// Files and paths that don't exist yet are watched through their parent
+	return w.addWatch(filepath.Dir(fullPath), watchTarget{path: path, name: filepath.Base(fullPath)})
+}
+
+// watchTree watches a directory and every directory below it
+func (w *inotifyWatcher) watchTree(root, path string) error {
+	return filepath.WalkDir(root, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Subdirectories we can't read can't be synced either
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.addWatch(dir, watchTarget{path: path})
+	})
+}
+
+func (w *inotifyWatcher) addWatch(dir string, target watchTarget) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirs[int32(wd)] = dir
+	for _, existing := range w.targets[int32(wd)] {
+		if existing == target {
+			return nil
+		}
+	}
+	w.targets[int32(wd)] = append(w.targets[int32(wd)], target)
+	return nil
+}
+
+// readEvents turns raw inotify events into changed tracked paths until the watcher is closed
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.changes)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		changed := make(map[string]bool)
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameBytes := buf[nameStart : nameStart+int(event.Len)]
+			offset = nameStart + int(event.Len)
+
+			name := string(nameBytes)
+			for i, c := range nameBytes {
+				if c == 0 {
+					name = string(nameBytes[:i])
+					break
+				}
+			}
+			for _, path := range w.handleEvent(event.Wd, event.Mask, name) {
+				changed[path] = true
+			}
+		}
+
+		for path := range changed {
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// handleEvent returns the tracked paths an event belongs to, and watches new subdirectories
+func (w *inotifyWatcher) handleEvent(wd int32, mask uint32, name string) []string {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// The kernel dropped events, so any path may have changed and new directories may lack watches
+		for _, path := range w.paths {
+			w.watchPath(path)
+		}
+		return w.paths
+	}
+
+	w.mu.Lock()
+	targets := w.targets[wd]
+	dir := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.targets, wd)
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+
+	var paths []string
+	for _, target := range targets {
+		if target.name != "" && target.name != name {
+			continue
+		}
+		paths = append(paths, target.path)
+
+		// A directory created inside a tracked directory needs its own watches
+		if target.name == "" && mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			w.watchTree(filepath.Join(dir, name), target.path)
+		}
+	}
+	return paths
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	return w.file.Close()
+}
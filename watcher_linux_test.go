@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestInotifyOverflowReportsEveryPath(t *testing.T) {
+	env := newTestEnv(t)
+	zshrc := env.writeHome(".zshrc", "export EDITOR=vim\n")
+	env.writeHome(".config/nvim/init.lua", "vim.opt.number = true\n")
+	paths := []string{zshrc, "~/.config/nvim"}
+
+	w, err := newInotifyWatcher(paths)
+	if err != nil {
+		t.Skipf("inotify unavailable: %v", err)
+	}
+	defer w.Close()
+
+	// Created while events were being dropped
+	os.MkdirAll(filepath.Join(env.home, ".config", "nvim", "lua"), 0755)
+
+	got := w.handleEvent(-1, syscall.IN_Q_OVERFLOW, "")
+	slices.Sort(got)
+	if want := []string{"~/.config/nvim", zshrc}; !slices.Equal(got, want) {
+		t.Errorf("overflow reported %v, want %v", got, want)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !slices.Contains(slices.Collect(maps.Values(w.dirs)), filepath.Join(env.home, ".config", "nvim", "lua")) {
+		t.Errorf("no watch for a directory created during the overflow: %v", w.dirs)
+	}
+}
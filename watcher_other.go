@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// newChangeWatcher polls for changes where inotify isn't available
+func newChangeWatcher(paths []string) (changeWatcher, error) {
+	return newPollWatcher(paths, 2*time.Second), nil
+}